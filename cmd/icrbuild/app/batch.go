@@ -0,0 +1,61 @@
+// ------------------------------------------------------------------------------
+// Copyright IBM Corp. 2018
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ------------------------------------------------------------------------------
+
+// Package app ...
+package app
+
+import (
+	"io"
+
+	"github.com/IBM-Cloud/container-registry-builder/pkg/icrbuild"
+	"github.com/spf13/cobra"
+)
+
+// newBatchCommand builds the images listed in a manifest with one session
+func newBatchCommand(out io.Writer, err io.Writer) *cobra.Command {
+	options := icrbuild.NewBatchOptions(out, err)
+	cmd := &cobra.Command{
+		Use:   "batch -f MANIFEST",
+		Short: "Build the images listed in a manifest, authenticating once",
+		Args:  usageArgs(cobra.NoArgs),
+		Long: `
+The manifest lists the builds in YAML:
+
+  builds:
+  - name: api
+    context: services/api
+    file: Dockerfile
+    tags:
+    - us.icr.io/mynamespace/api:latest
+    buildArgs:
+    - VERSION=1.2.3
+
+A local context is relative to the manifest, the file is relative to the
+context. noCache, pull and squash can be set for each build. All images must
+be in the same registry.
+ `,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return options.Run(cmd, args)
+		},
+	}
+
+	cmd.SetFlagErrorFunc(flagError)
+	cmd.Flags().StringVarP(&options.Manifest, "manifest", "f", "", "The YAML file listing the builds.")
+	cmd.MarkFlagRequired("manifest")
+	cmd.Flags().IntVar(&options.Parallel, "parallel", icrbuild.DefaultBatchParallel, "Optional: How many builds run at the same time.")
+	addSharedFlags(cmd.Flags(), &options.Flags)
+	return cmd
+}
@@ -21,33 +21,58 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/IBM-Cloud/container-registry-builder/pkg/icrbuild"
 	"github.com/IBM-Cloud/container-registry-builder/pkg/icrbuild/version"
+	"github.com/moby/buildkit/util/appdefaults"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
-const logLevel = "debug"
+const (
+	defaultLogLevel = "debug"
+
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
 
 // NewCommand creates the icrbuild command
 func NewCommand(in io.Reader, out io.Writer, err io.Writer) *cobra.Command {
 	options := icrbuild.NewBuildOptions(in, out, err)
+	logLevel := defaultLogLevel
+	logFormat := logFormatText
 	cmd := &cobra.Command{
-		Use:   "icrbuild [DIRECTORY]",
+		Use:   "icrbuild [DIRECTORY | URL | -]",
 		Short: "Build a Docker image in IBM Cloud Container Registry using builder contract",
-		Args:  cobra.ExactArgs(1),
+		Args:  usageArgs(cobra.MaximumNArgs(1)),
 		Long: `
+The build context is a local DIRECTORY, a git repository URL such as
+https://github.com/user/repo.git#ref:subdir, the URL of a tar archive or '-'
+to read a tar archive from stdin. Remote contexts are fetched before the build.
+
+Every flag can also be set with an ICRBUILD_ environment variable, for example
+ICRBUILD_BUILD_ARG for --build-arg and ICRBUILD_CONTEXT for DIRECTORY.
+Repeatable flags take a comma or newline separated list.
  `,
-		Run: func(cmd *cobra.Command, args []string) {
-			err := options.Run(cmd, args)
-			if err != nil {
-				logrus.Error(err)
-			}
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return options.Run(cmd, args)
 		},
+		// Errors are logged by main along with the exit code
+		SilenceErrors: true,
 		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
-			if err := setUpLogs(err); err != nil {
-				return err
+			if err := applyEnvironment(cmd.Flags()); err != nil {
+				return icrbuild.UsageError(err)
+			}
+			// Checked before cobra does so that the error is a usage error,
+			// and after the environment has set the flags
+			if err := checkRequiredFlags(cmd.Flags()); err != nil {
+				return icrbuild.UsageError(err)
+			}
+			if err := setUpLogs(err, logLevel, logFormat); err != nil {
+				return icrbuild.UsageError(err)
 			}
 			cmd.SilenceUsage = true
 			logrus.Infof("icrbuild %+v", version.Get())
@@ -55,28 +80,108 @@ func NewCommand(in io.Reader, out io.Writer, err io.Writer) *cobra.Command {
 		},
 	}
 
+	cmd.SetFlagErrorFunc(flagError)
 	cmd.Version = fmt.Sprintf("%+v", version.Get())
 	cmd.SetVersionTemplate("{{printf .Version}}\n")
 
-	//	[--no-cache] [--pull] [--quiet | -q] [--build-arg KEY=VALUE ...] [--file FILE | -f FILE] --tag TAG DIRECTORY
-	cmd.PersistentFlags().BoolVar(&options.Flags.NoCache, "no-cache", false, "Optional: If specified, cached image layers from previous builds are not used in this build.")
-	cmd.PersistentFlags().BoolVar(&options.Flags.Pull, "pull", false, "Optional: If specified, the base images are pulled even if an image with a matching tag already exists on the build host.")
-	cmd.PersistentFlags().BoolVarP(&options.Flags.Quiet, "quiet", "q", false, "Optional: If specified, the build output is suppressed unless an error occurs.")
-	cmd.PersistentFlags().StringArrayVar(&options.Flags.BuildArgs, "build-arg", nil, "Optional: Specify an additional build argument in the format 'KEY=VALUE'. The value of each build argument is available as an environment variable when you specify an ARG line that matches the key in your Dockerfile.")
-	cmd.PersistentFlags().StringVarP(&options.Flags.File, "file", "f", "", "Optional: Specify the location of the Dockerfile relative to the build context. If not specified, the default is 'PATH/Dockerfile', where PATH is the root of the build context.")
-	cmd.PersistentFlags().StringVarP(&options.Flags.Tag, "tag", "t", "", "The full name for the image that you want to build, which includes the registry URL and namespace.")
+	//	[--no-cache] [--pull] [--quiet | -q] [--squash] [--build-arg KEY=VALUE ...] [--file FILE | -f FILE] --tag TAG [--tag TAG ...] DIRECTORY
+	cmd.Flags().BoolVar(&options.Flags.NoCache, "no-cache", false, "Optional: If specified, cached image layers from previous builds are not used in this build.")
+	cmd.Flags().BoolVar(&options.Flags.Pull, "pull", false, "Optional: If specified, the base images are pulled even if an image with a matching tag already exists on the build host.")
+	cmd.Flags().BoolVarP(&options.Flags.Quiet, "quiet", "q", false, "Optional: If specified, the build output is suppressed unless an error occurs.")
+	cmd.Flags().BoolVar(&options.Flags.Squash, "squash", false, "Optional: If specified, the filesystem of the built image is reduced to one layer before it is pushed to the registry.")
+	cmd.Flags().StringArrayVar(&options.Flags.BuildArgs, "build-arg", nil, "Optional: Specify an additional build argument in the format 'KEY=VALUE'. The value of each build argument is available as an environment variable when you specify an ARG line that matches the key in your Dockerfile.")
+	cmd.Flags().StringVarP(&options.Flags.File, "file", "f", "", "Optional: Specify the location of the Dockerfile relative to the build context. If not specified, the default is 'PATH/Dockerfile', where PATH is the root of the build context.")
+	cmd.Flags().StringArrayVarP(&options.Flags.Tags, "tag", "t", nil, "The full name for the image that you want to build, which includes the registry URL and namespace. Repeat the flag to push the image under additional tags.")
 	cmd.MarkFlagRequired("tag")
+	addSharedFlags(cmd.Flags(), &options.Flags)
+	cmd.Flags().IntVar(&options.Flags.Retain, "retain", 0, "Optional: After a successful build, delete all but the newest N images of the repository.")
+	cmd.Flags().StringVar(&options.Flags.RetainWithin, "retain-within", "", "Optional: After a successful build, delete the images of the repository that are older than this, for example '30d' or '12h'. Combined with --retain, images that satisfy either are kept.")
+	cmd.Flags().StringVar(&options.Flags.RetainProtect, "retain-protect", "", "Optional: A regular expression for tags that are never deleted by --retain or --retain-within, for example '^(latest|v[0-9.]+)$'.")
+	cmd.Flags().BoolVar(&options.Flags.RetainDryRun, "retain-dry-run", false, "Optional: Report the images that --retain or --retain-within would delete without deleting them.")
+	cmd.Flags().BoolVar(&options.Flags.DryRun, "dry-run", false, "Optional: Print the registry, account, image names, Dockerfile, build args and context files the build would use, then exit without authenticating or uploading.")
+	cmd.Flags().StringVarP(&options.Flags.Output, "output", "o", icrbuild.OutputText, "Optional: The output format, 'text' or 'json'. With 'json' the build progress is written as one JSON event per line.")
+	cmd.Flags().StringVar(&options.Flags.DigestFile, "digest-file", "", "Optional: Write the digest of the pushed image to this file.")
+	cmd.Flags().StringVar(&options.Flags.ResultsDir, "results-dir", "", "Optional: Write the digest and name of the pushed image to the IMAGE_DIGEST and IMAGE_URL files in this directory.")
+	cmd.Flags().StringVar(&options.Flags.VAPolicy, "va-policy", "", "Optional: Fail the build if the Vulnerability Advisor report of the image violates the policy, a comma separated list of 'vulnerabilities=N', 'compliance=N' and 'malware=allow|deny'. Malware is denied unless allowed.")
+	cmd.Flags().DurationVar(&options.Flags.VATimeout, "va-timeout", 10*time.Minute, "Optional: How long to wait for the Vulnerability Advisor to scan the image.")
+	cmd.Flags().StringVar(&options.Flags.VAAction, "va-action", icrbuild.VAActionFail, "Optional: What to do with an image that violates the Vulnerability Advisor policy, one of 'fail', 'delete' or 'retag'. 'delete' deletes every tag of the build, 'retag' moves each of them to a tag ending in '-va-failed'.")
+	cmd.PersistentFlags().StringVar(&logLevel, "log-level", logLevel, "Optional: The log level, one of 'trace', 'debug', 'info', 'warning' or 'error'. 'trace' also logs the HTTP requests.")
+	cmd.PersistentFlags().StringVar(&logFormat, "log-format", logFormat, "Optional: The log format, 'text' or 'json'.")
+
+	cmd.AddCommand(newTemplateCommand(cmd, out))
+	cmd.AddCommand(newBatchCommand(out, err))
 
 	return cmd
 }
 
-func setUpLogs(out io.Writer) error {
-	logrus.SetOutput(out)
+// flagError makes an unknown flag or an invalid flag value exit with the
+// usage exit code
+func flagError(cmd *cobra.Command, err error) error {
+	return icrbuild.UsageError(err)
+}
+
+// usageArgs makes the errors of an argument validator usage errors
+func usageArgs(args cobra.PositionalArgs) cobra.PositionalArgs {
+	return func(cmd *cobra.Command, argv []string) error {
+		if err := args(cmd, argv); err != nil {
+			return icrbuild.UsageError(err)
+		}
+		return nil
+	}
+}
+
+// checkRequiredFlags reports the flags marked required that are not set
+func checkRequiredFlags(flags *pflag.FlagSet) error {
+	var missing []string
+	flags.VisitAll(func(flag *pflag.Flag) {
+		required, ok := flag.Annotations[cobra.BashCompOneRequiredFlag]
+		if ok && len(required) > 0 && required[0] == "true" && !flag.Changed {
+			missing = append(missing, flag.Name)
+		}
+	})
+	if len(missing) > 0 {
+		return fmt.Errorf(`required flag(s) "%s" not set`, strings.Join(missing, `", "`))
+	}
+	return nil
+}
+
+// addSharedFlags defines the flags that apply to each build of a batch too
+func addSharedFlags(flags *pflag.FlagSet, f *icrbuild.BuildFlags) {
+	flags.StringVar(&f.Backend, "backend", icrbuild.BackendRemote, "Optional: Where to build, 'remote' for the IBM Cloud Container Registry build service, 'docker' for the docker daemon of DOCKER_HOST, which then pushes the image, or 'buildkit' for a BuildKit daemon.")
+	flags.StringVar(&f.BuildKitAddress, "buildkit-addr", "", "Optional: The address of the BuildKit daemon used by --backend buildkit. Defaults to BUILDKIT_HOST or '"+appdefaults.Address+"'.")
+	flags.StringVar(&f.MaxContextSize, "max-context-size", "", "Optional: Fail before uploading if the files of the build context add up to more than this size, for example '500MB'. The biggest files and directories are listed.")
+	flags.BoolVar(&f.CreateNamespace, "create-namespace", false, "Optional: Create the namespace of the image if it does not exist in the account.")
+	flags.Float64Var(&f.QuotaWarnThreshold, "quota-warn-threshold", icrbuild.DefaultQuotaWarnThreshold, "Optional: Warn when the storage or pull traffic usage of the account reaches this percentage of its quota.")
+	flags.StringVar(&f.Region, "region", "", "Optional: The IBM Cloud region to build in, for example 'us-south'. Defaults to IBMCLOUD_REGION, or to the region of the registry in the image name.")
+	flags.StringVar(&f.Registry, "registry", "", "Optional: The registry to push to when the image name does not include one, for example 'de.icr.io'. Defaults to the registry of the selected region.")
+	flags.StringVar(&f.APIKeyFile, "apikey-file", "", "Optional: A file containing the IBM Cloud API key, for example a mounted secret. Takes precedence over the IBMCLOUD_API_KEY and BLUEMIX_API_KEY environment variables, the docker config and the IBM Cloud CLI session.")
+	flags.StringVar(&f.TrustedProfile, "trusted-profile", "", "Optional: The ID or CRN of an IBM Cloud trusted profile to authenticate as with a compute resource token. Defaults to IBMCLOUD_TRUSTED_PROFILE_ID.")
+	flags.StringVar(&f.CRTokenFile, "cr-token-file", "", "Optional: The compute resource token used with --trusted-profile. Defaults to IBMCLOUD_CR_TOKEN_FILE or '"+icrbuild.DefaultCRTokenFile+"'.")
+	flags.StringVar(&f.IAMTokenFile, "iam-token-file", "", "Optional: A file containing an IAM access token that is kept up to date, for example by a sidecar.")
+	flags.IntVar(&f.MaxAttempts, "max-attempts", icrbuild.DefaultRetryPolicy.MaxAttempts, "Optional: How many times to send a request that fails with a transient error, such as a 503 from the build service or a dropped connection. 1 disables retries.")
+	flags.DurationVar(&f.Timeout, "timeout", 0, "Optional: Abort the build if it has not completed within this duration, for example '30m'. The default is no timeout.")
+}
+
+// setUpLogs with API keys, IAM tokens and authorization headers redacted
+func setUpLogs(out io.Writer, logLevel string, logFormat string) error {
+	var formatter logrus.Formatter
+
 	lvl, err := logrus.ParseLevel(logLevel)
 	if err != nil {
 		return err
 	}
+	switch logFormat {
+	case logFormatText:
+		formatter = &logrus.TextFormatter{}
+	case logFormatJSON:
+		formatter = &logrus.JSONFormatter{}
+	default:
+		return fmt.Errorf("Unknown log format %s, expected %s or %s", logFormat, logFormatText, logFormatJSON)
+	}
+
+	logrus.SetOutput(out)
 	logrus.SetLevel(lvl)
+	logrus.SetFormatter(&icrbuild.RedactingFormatter{Formatter: formatter})
 	return nil
 }
 
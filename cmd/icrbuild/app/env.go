@@ -0,0 +1,73 @@
+// ------------------------------------------------------------------------------
+// Copyright IBM Corp. 2018
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ------------------------------------------------------------------------------
+
+// Package app ...
+package app
+
+import (
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+// envPrefix of the environment variables that supply flags
+const envPrefix = "ICRBUILD_"
+
+// flagEnvVar is the environment variable for a flag, --build-arg is ICRBUILD_BUILD_ARG
+func flagEnvVar(name string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// applyEnvironment sets the flags that are not given on the command line from
+// their ICRBUILD_* environment variables, so that a Tekton Task can pass its
+// params as env. Empty variables are ignored. Repeatable flags take a list
+// separated by newlines, or by commas when the value has no newline.
+func applyEnvironment(flags *pflag.FlagSet) error {
+	var err error
+	flags.VisitAll(func(flag *pflag.Flag) {
+		value := os.Getenv(flagEnvVar(flag.Name))
+		if err != nil || value == "" || flag.Changed {
+			return
+		}
+		values := []string{value}
+		if strings.HasSuffix(flag.Value.Type(), "Array") || strings.HasSuffix(flag.Value.Type(), "Slice") {
+			values = splitList(value)
+		}
+		for _, value := range values {
+			if serr := flags.Set(flag.Name, value); serr != nil {
+				err = errors.Wrapf(serr, "Invalid value of %s", flagEnvVar(flag.Name))
+				return
+			}
+		}
+	})
+	return err
+}
+
+func splitList(value string) []string {
+	separator := ","
+	if strings.Contains(value, "\n") {
+		separator = "\n"
+	}
+	var values []string
+	for _, item := range strings.Split(value, separator) {
+		if item = strings.TrimSpace(item); item != "" {
+			values = append(values, item)
+		}
+	}
+	return values
+}
@@ -0,0 +1,294 @@
+// ------------------------------------------------------------------------------
+// Copyright IBM Corp. 2018
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ------------------------------------------------------------------------------
+
+// Package app ...
+package app
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/IBM-Cloud/container-registry-builder/pkg/icrbuild"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v2"
+)
+
+// Kinds of manifests the template command emits
+const (
+	templateKindBuildTemplate = "buildtemplate"
+	templateKindTask          = "task"
+	templateKindSecret        = "secret"
+	templateKindAll           = "all"
+
+	// The build context DIRECTORY, relative to the workspace
+	contextParam        = "context"
+	knativeContextParam = "DIRECTORY"
+	// The step resolves a relative Dockerfile path against its working
+	// directory, the workspace, rather than the build context
+	fileDescription = "The location of the Dockerfile relative to the %s. If not specified, the default is the Dockerfile at the root of the build context."
+)
+
+type templateOptions struct {
+	name     string
+	image    string
+	kind     string
+	registry string
+	secret   string
+}
+
+// Kubernetes objects, only the fields that the templates use
+
+type objectMeta struct {
+	Name        string            `yaml:"name"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+type envVar struct {
+	Name  string `yaml:"name"`
+	Value string `yaml:"value"`
+}
+
+type step struct {
+	Name       string   `yaml:"name"`
+	Image      string   `yaml:"image"`
+	WorkingDir string   `yaml:"workingDir,omitempty"`
+	Env        []envVar `yaml:"env"`
+}
+
+type param struct {
+	Name        string  `yaml:"name"`
+	Description string  `yaml:"description"`
+	Type        string  `yaml:"type,omitempty"`
+	Default     *string `yaml:"default,omitempty"`
+}
+
+type namedDescription struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description"`
+}
+
+type buildTemplate struct {
+	APIVersion string     `yaml:"apiVersion"`
+	Kind       string     `yaml:"kind"`
+	Metadata   objectMeta `yaml:"metadata"`
+	Spec       struct {
+		Parameters []param `yaml:"parameters"`
+		Steps      []step  `yaml:"steps"`
+	} `yaml:"spec"`
+}
+
+type task struct {
+	APIVersion string     `yaml:"apiVersion"`
+	Kind       string     `yaml:"kind"`
+	Metadata   objectMeta `yaml:"metadata"`
+	Spec       struct {
+		Params     []param            `yaml:"params"`
+		Workspaces []namedDescription `yaml:"workspaces"`
+		Results    []namedDescription `yaml:"results"`
+		Steps      []step             `yaml:"steps"`
+	} `yaml:"spec"`
+}
+
+type secret struct {
+	APIVersion string            `yaml:"apiVersion"`
+	Kind       string            `yaml:"kind"`
+	Metadata   objectMeta        `yaml:"metadata"`
+	Type       string            `yaml:"type"`
+	StringData map[string]string `yaml:"stringData"`
+}
+
+type serviceAccount struct {
+	APIVersion string       `yaml:"apiVersion"`
+	Kind       string       `yaml:"kind"`
+	Metadata   objectMeta   `yaml:"metadata"`
+	Secrets    []objectMeta `yaml:"secrets"`
+}
+
+// newTemplateCommand emits the manifests that run icrbuild in a cluster. The
+// params are generated from the flags of build so they never drift apart.
+func newTemplateCommand(build *cobra.Command, out io.Writer) *cobra.Command {
+	options := &templateOptions{}
+	cmd := &cobra.Command{
+		Use:   "template",
+		Short: "Print a knative BuildTemplate, a Tekton Task and an example ServiceAccount and Secret for icrbuild",
+		Args:  usageArgs(cobra.NoArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return options.run(build, out)
+		},
+	}
+
+	cmd.SetFlagErrorFunc(flagError)
+	cmd.Flags().StringVar(&options.image, "image", "", "The icrbuild image the steps run, built from the Dockerfile of this repository.")
+	cmd.MarkFlagRequired("image")
+	cmd.Flags().StringVar(&options.name, "name", "icrbuild", "Optional: The name of the BuildTemplate, the Task and the ServiceAccount.")
+	cmd.Flags().StringVar(&options.kind, "kind", templateKindAll, "Optional: The manifests to print, one of 'buildtemplate', 'task', 'secret' or 'all'. 'secret' prints the ServiceAccount and the Secret.")
+	cmd.Flags().StringVar(&options.registry, "registry", "us.icr.io", "Optional: The registry the Secret holds the API key for.")
+	cmd.Flags().StringVar(&options.secret, "secret", "icr-apikey", "Optional: The name of the Secret.")
+	return cmd
+}
+
+func (o *templateOptions) run(build *cobra.Command, out io.Writer) error {
+	var manifests []interface{}
+
+	switch o.kind {
+	case templateKindBuildTemplate:
+		manifests = append(manifests, o.buildTemplate(build))
+	case templateKindTask:
+		manifests = append(manifests, o.task(build))
+	case templateKindSecret:
+		manifests = append(manifests, o.serviceAccount(), o.secretManifest())
+	case templateKindAll:
+		manifests = append(manifests, o.buildTemplate(build), o.task(build), o.serviceAccount(), o.secretManifest())
+	default:
+		return icrbuild.UsageError(errors.Errorf("Unknown kind %s, expected %s, %s, %s or %s", o.kind, templateKindBuildTemplate, templateKindTask, templateKindSecret, templateKindAll))
+	}
+
+	for _, manifest := range manifests {
+		data, err := yaml.Marshal(manifest)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "---\n%s", data)
+	}
+	return nil
+}
+
+// templateFlags are the build flags that become params, all but help and version
+func templateFlags(build *cobra.Command) []*pflag.Flag {
+	var flags []*pflag.Flag
+	build.LocalFlags().VisitAll(func(flag *pflag.Flag) {
+		if flag.Name != "help" && flag.Name != "version" {
+			flags = append(flags, flag)
+		}
+	})
+	return flags
+}
+
+// templateParam describes the flag, optional flags get the default of the
+// binary so that leaving them out of a run changes nothing
+func templateParam(flag *pflag.Flag, name string) param {
+	p := param{
+		Name:        name,
+		Description: strings.TrimPrefix(flag.Usage, "Optional: "),
+	}
+	list := strings.HasSuffix(flag.Value.Type(), "Array") || strings.HasSuffix(flag.Value.Type(), "Slice")
+	if list {
+		p.Description += " A comma separated list."
+	}
+	if _, required := flag.Annotations[cobra.BashCompOneRequiredFlag]; !required {
+		value := flag.DefValue
+		if list {
+			value = ""
+		}
+		p.Default = &value
+	}
+	return p
+}
+
+func (o *templateOptions) buildTemplate(build *cobra.Command) *buildTemplate {
+	t := &buildTemplate{APIVersion: "build.knative.dev/v1alpha1", Kind: "BuildTemplate"}
+	t.Metadata.Name = o.name
+
+	// knative parameters are conventionally upper case
+	paramName := func(name string) string {
+		return strings.TrimPrefix(flagEnvVar(name), envPrefix)
+	}
+	contextDefault := "."
+	buildStep := step{Name: "build", Image: o.image}
+	t.Spec.Parameters = append(t.Spec.Parameters, param{
+		Name:        knativeContextParam,
+		Description: "The directory of the build context, relative to the workspace.",
+		Default:     &contextDefault,
+	})
+	buildStep.Env = append(buildStep.Env, envVar{Name: flagEnvVar(contextParam), Value: "/workspace/${" + knativeContextParam + "}"})
+	for _, flag := range templateFlags(build) {
+		p := templateParam(flag, paramName(flag.Name))
+		if flag.Name == "file" {
+			p.Description = fmt.Sprintf(fileDescription, "workspace")
+		}
+		t.Spec.Parameters = append(t.Spec.Parameters, p)
+		buildStep.Env = append(buildStep.Env, envVar{Name: flagEnvVar(flag.Name), Value: "${" + paramName(flag.Name) + "}"})
+	}
+	t.Spec.Steps = []step{buildStep}
+	return t
+}
+
+func (o *templateOptions) task(build *cobra.Command) *task {
+	t := &task{APIVersion: "tekton.dev/v1beta1", Kind: "Task"}
+	t.Metadata.Name = o.name
+
+	contextDefault := "."
+	buildStep := step{Name: "build", Image: o.image, WorkingDir: "$(workspaces.source.path)"}
+	t.Spec.Params = append(t.Spec.Params, param{
+		Name:        contextParam,
+		Description: "The directory of the build context, relative to the source workspace.",
+		Type:        "string",
+		Default:     &contextDefault,
+	})
+	buildStep.Env = append(buildStep.Env, envVar{Name: flagEnvVar(contextParam), Value: "$(workspaces.source.path)/$(params." + contextParam + ")"})
+	for _, flag := range templateFlags(build) {
+		p := templateParam(flag, flag.Name)
+		p.Type = "string"
+		if flag.Name == "file" {
+			p.Description = fmt.Sprintf(fileDescription, "source workspace")
+		}
+		t.Spec.Params = append(t.Spec.Params, p)
+		buildStep.Env = append(buildStep.Env, envVar{Name: flagEnvVar(flag.Name), Value: "$(params." + flag.Name + ")"})
+	}
+	t.Spec.Workspaces = []namedDescription{{Name: "source", Description: "The source to build."}}
+	t.Spec.Results = []namedDescription{
+		{Name: "IMAGE_DIGEST", Description: "The digest of the pushed image."},
+		{Name: "IMAGE_URL", Description: "The name of the pushed image."},
+		{Name: "BUILD_DURATION", Description: "How long the build took, in seconds."},
+	}
+	t.Spec.Steps = []step{buildStep}
+	return t
+}
+
+func (o *templateOptions) serviceAccount() *serviceAccount {
+	return &serviceAccount{
+		APIVersion: "v1",
+		Kind:       "ServiceAccount",
+		Metadata:   objectMeta{Name: o.name},
+		Secrets:    []objectMeta{{Name: o.secret}},
+	}
+}
+
+// secretManifest holds the API key as the password of the registry, the
+// build and pipeline controllers write it to the docker config.json of the
+// steps where icrbuild finds it
+func (o *templateOptions) secretManifest() *secret {
+	registry := "https://" + o.registry
+	return &secret{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Metadata: objectMeta{
+			Name: o.secret,
+			Annotations: map[string]string{
+				"build.knative.dev/docker-0": registry,
+				"tekton.dev/docker-0":        registry,
+			},
+		},
+		Type: "kubernetes.io/basic-auth",
+		StringData: map[string]string{
+			"username": "iamapikey",
+			"password": "<IBM Cloud API key>",
+		},
+	}
+}
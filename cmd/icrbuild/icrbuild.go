@@ -21,13 +21,14 @@ import (
 	"os"
 
 	"github.com/IBM-Cloud/container-registry-builder/cmd/icrbuild/app"
+	"github.com/IBM-Cloud/container-registry-builder/pkg/icrbuild"
 	"github.com/sirupsen/logrus"
 )
 
 func main() {
 	if err := app.Run(); err != nil {
-		logrus.Fatal(err)
-		os.Exit(1)
+		logrus.Errorf("%v (%s error)", err, icrbuild.ClassOf(err))
+		os.Exit(icrbuild.ExitCode(err))
 	}
 	os.Exit(0)
 }
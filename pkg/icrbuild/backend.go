@@ -0,0 +1,114 @@
+// ------------------------------------------------------------------------------
+// Copyright IBM Corp. 2018
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ------------------------------------------------------------------------------
+
+// Package icrbuild ...
+package icrbuild
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+
+	"github.com/docker/cli/cli/command"
+	"github.com/docker/cli/cli/command/image"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// Build backends
+const (
+	// BackendRemote builds with the IBM Cloud Container Registry build service
+	BackendRemote = "remote"
+	// BackendDocker builds with a local docker daemon and pushes the image
+	BackendDocker = "docker"
+	// BackendBuildKit builds and pushes with a BuildKit daemon
+	BackendBuildKit = "buildkit"
+)
+
+// Backend builds an image and pushes it to the registry of the session
+type Backend interface {
+	// Build the context directory as imageName and return the digest of
+	// the pushed image, empty when the backend does not report it
+	Build(ctx context.Context, imageName string, contextDir string) (string, error)
+}
+
+// validateBackend checks the --backend flag
+func (o *BuildOptions) validateBackend() error {
+	switch o.Flags.Backend {
+	case "", BackendRemote, BackendDocker, BackendBuildKit:
+		return nil
+	}
+	return errors.Errorf("Unknown backend %s, expected %s, %s or %s", o.Flags.Backend, BackendRemote, BackendDocker, BackendBuildKit)
+}
+
+// newBackend selected by the flags
+func (o *BuildOptions) newBackend(registryClient *IBMRegistrySession) Backend {
+	switch o.Flags.Backend {
+	case BackendDocker:
+		return &dockerBackend{options: o, registryClient: registryClient}
+	case BackendBuildKit:
+		return &buildKitBackend{options: o, registryClient: registryClient}
+	}
+	return &remoteBackend{options: o, registryClient: registryClient}
+}
+
+// remoteBackend sends the context to the build service, which pushes the image
+type remoteBackend struct {
+	options        *BuildOptions
+	registryClient *IBMRegistrySession
+}
+
+func (b *remoteBackend) Build(ctx context.Context, imageName string, contextDir string) (string, error) {
+	o := b.options
+	builder := NewBuilder(ctx, b.registryClient)
+	builder.events = o.events
+	builder.log = o.log
+
+	ccmd := o.newDockerBuildCommand(builder, imageName)
+	err := ccmd.RunE(nil, []string{contextDir})
+	return builder.Digest(), err
+}
+
+// newDockerBuildCommand is the docker CLI build command with the flags of
+// the build, it packs the context and renders the build stream of apiClient
+func (o *BuildOptions) newDockerBuildCommand(apiClient client.APIClient, imageName string) *cobra.Command {
+	// The events replace the docker CLI rendering of the build stream
+	var out io.Writer = o.Out
+	if o.events.enabled() {
+		out = ioutil.Discard
+	}
+	cli := &builderCLI{*command.NewDockerCli(os.Stdin, out, o.Err, false), apiClient}
+
+	ccmd := image.NewBuildCommand(cli)
+
+	ccmd.Flags().Set("tag", imageName)
+	ccmd.Flags().Set("no-cache", strconv.FormatBool(o.Flags.NoCache))
+	ccmd.Flags().Set("quiet", strconv.FormatBool(o.Flags.Quiet))
+	ccmd.Flags().Set("pull", strconv.FormatBool(o.Flags.Pull))
+	ccmd.Flags().Set("squash", strconv.FormatBool(o.Flags.Squash))
+	ccmd.Flags().Set("disable-content-trust", "true")
+	ccmd.Flags().Set("file", o.Flags.File)
+	for _, buildFlag := range o.Flags.BuildArgs {
+		ccmd.Flags().Set("build-arg", buildFlag)
+	}
+
+	// Woraround a defect whem term is set
+	os.Unsetenv("TERM")
+	return ccmd
+}
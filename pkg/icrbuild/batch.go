@@ -0,0 +1,335 @@
+// ------------------------------------------------------------------------------
+// Copyright IBM Corp. 2018
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ------------------------------------------------------------------------------
+
+// Package icrbuild ...
+package icrbuild
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/pkg/urlutil"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultBatchParallel is how many builds of a batch run at the same time
+const DefaultBatchParallel = 4
+
+// BatchManifest lists the images of a batch
+type BatchManifest struct {
+	Builds []BatchBuild `yaml:"builds"`
+}
+
+// BatchBuild is one image of a batch. A local context is relative to the
+// manifest and the Dockerfile is relative to the context.
+type BatchBuild struct {
+	Name      string   `yaml:"name"`
+	Context   string   `yaml:"context"`
+	File      string   `yaml:"file"`
+	Tags      []string `yaml:"tags"`
+	BuildArgs []string `yaml:"buildArgs"`
+	NoCache   bool     `yaml:"noCache"`
+	Pull      bool     `yaml:"pull"`
+	Squash    bool     `yaml:"squash"`
+}
+
+// BatchOptions hold the io streams and the flags shared by the builds of a batch
+type BatchOptions struct {
+	Out io.Writer
+	Err io.Writer
+
+	Manifest string
+	Parallel int
+	// Flags of every build, the tags, Dockerfile, build args and cache
+	// flags are taken from the manifest
+	Flags BuildFlags
+
+	// ContextFetchers stage contexts that are not a local directory,
+	// DefaultContextFetchers when nil
+	ContextFetchers []ContextFetcher
+}
+
+type batchResult struct {
+	name     string
+	image    string
+	digest   string
+	duration time.Duration
+	err      error
+}
+
+// NewBatchOptions hold the streams for the batch
+func NewBatchOptions(out io.Writer, err io.Writer) *BatchOptions {
+	return &BatchOptions{
+		Out:      out,
+		Err:      err,
+		Parallel: DefaultBatchParallel,
+	}
+}
+
+// ReadBatchManifest parses the YAML manifest of a batch
+func ReadBatchManifest(path string) (*BatchManifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to read the batch manifest")
+	}
+	manifest := &BatchManifest{}
+	if err = yaml.UnmarshalStrict(data, manifest); err != nil {
+		return nil, errors.Wrapf(err, "Unable to parse the batch manifest %s", path)
+	}
+	if len(manifest.Builds) == 0 {
+		return nil, errors.Errorf("Batch manifest %s has no builds", path)
+	}
+	return manifest, nil
+}
+
+// Run the builds of the manifest with one session
+func (o *BatchOptions) Run(cmd *cobra.Command, args []string) error {
+	if o.Parallel < 1 {
+		return newBuildError(ErrUsage, errors.Errorf("Parallel builds %d must be at least 1", o.Parallel))
+	}
+	manifest, err := ReadBatchManifest(o.Manifest)
+	if err != nil {
+		return newBuildError(ErrUsage, err)
+	}
+
+	// Every build is validated before the first one starts
+	var (
+		mu         sync.Mutex
+		builds     []*BuildOptions
+		outputs    []*prefixWriter
+		errOutputs []*prefixWriter
+	)
+	log := logrus.StandardLogger()
+	names := map[string]bool{}
+	for i, spec := range manifest.Builds {
+		name := batchBuildName(spec, i)
+		if names[name] {
+			return newBuildError(ErrUsage, errors.Errorf("Build name %s is not unique", name))
+		}
+		names[name] = true
+
+		prefix := "[" + name + "] "
+		out := &prefixWriter{mu: &mu, out: o.Out, prefix: prefix}
+		errOut := &prefixWriter{mu: &mu, out: o.Err, prefix: prefix}
+		build := NewBuildOptions(nil, out, errOut)
+		build.Flags = o.Flags
+		build.Flags.Tags = spec.Tags
+		build.Flags.File = spec.File
+		build.Flags.BuildArgs = spec.BuildArgs
+		build.Flags.NoCache = spec.NoCache
+		build.Flags.Pull = spec.Pull
+		build.Flags.Squash = spec.Squash
+		build.ContextFetchers = o.ContextFetchers
+		build.log = batchBuildLog(log, errOut, name)
+		if err = build.validate(); err != nil {
+			return errors.Wrapf(err, "Invalid build %s", name)
+		}
+		builds = append(builds, build)
+		outputs = append(outputs, out)
+		errOutputs = append(errOutputs, errOut)
+	}
+
+	ctx, cancel := newBuildContext(o.Flags.Timeout, logrus.NewEntry(log))
+	defer cancel()
+
+	registryClient, _, err := NewRegistryClient(ctx, builds[0].Flags.Tags[0], builds[0].sessionOptions())
+	if err != nil {
+		if ctx.Err() != nil {
+			return newBuildError(ErrCancelled, cancelledError(ctx))
+		}
+		return withClass(ErrAuth, errors.Wrap(err, "Unable to Connect to IBM Cloud"))
+	}
+
+	baseDir := filepath.Dir(o.Manifest)
+	results := make([]batchResult, len(builds))
+	slots := make(chan struct{}, o.Parallel)
+	var wg sync.WaitGroup
+	for i, build := range builds {
+		wg.Add(1)
+		go func(i int, build *BuildOptions, spec BatchBuild) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			start := time.Now()
+			result := &results[i]
+			result.name = batchBuildName(spec, i)
+			result.image, result.digest, result.err = build.runBatchBuild(ctx, registryClient, batchContextPath(baseDir, spec.Context))
+			result.duration = time.Since(start)
+			if result.err != nil {
+				build.log.Errorf("Build failed: %v", result.err)
+			}
+			outputs[i].Flush()
+			errOutputs[i].Flush()
+		}(i, build, manifest.Builds[i])
+	}
+	wg.Wait()
+
+	return printBatchSummary(o.Out, results)
+}
+
+// runBatchBuild stages the context and builds it with the shared session
+func (o *BuildOptions) runBatchBuild(ctx context.Context, registryClient *IBMRegistrySession, contextPath string) (string, string, error) {
+	if ctx.Err() != nil {
+		return "", "", newBuildError(ErrCancelled, cancelledError(ctx))
+	}
+	imageName, err := registryClient.ImageName(o.Flags.Tags[0])
+	if err != nil {
+		return "", "", newBuildError(ErrUsage, err)
+	}
+
+	contextPath, cleanup, err := o.stageContext(ctx, contextPath)
+	if err != nil {
+		return imageName, "", newBuildError(ErrContext, err)
+	}
+	defer cleanup()
+	if o.Flags.File != "" && !filepath.IsAbs(o.Flags.File) {
+		o.Flags.File = filepath.Join(contextPath, o.Flags.File)
+	}
+
+	if err = o.checkContextSize(contextPath); err != nil {
+		return imageName, "", err
+	}
+	digest, err := o.build(ctx, registryClient, imageName, contextPath)
+	return imageName, digest, err
+}
+
+// batchBuildLog writes the log lines of a build with its prefix to out, the
+// stderr of the build. JSON log lines can not be prefixed, they get a build
+// field instead.
+func batchBuildLog(log *logrus.Logger, out io.Writer, name string) *logrus.Entry {
+	if formatter, ok := log.Formatter.(*RedactingFormatter); ok {
+		if _, ok = formatter.Formatter.(*logrus.JSONFormatter); ok {
+			return logrus.NewEntry(log).WithField("build", name)
+		}
+	}
+	buildLog := logrus.New()
+	buildLog.Out = out
+	buildLog.Formatter = log.Formatter
+	buildLog.Hooks = log.Hooks
+	buildLog.Level = log.GetLevel()
+	return logrus.NewEntry(buildLog)
+}
+
+// batchBuildName is the name in the manifest, or the repository of the first tag
+func batchBuildName(spec BatchBuild, index int) string {
+	if spec.Name != "" {
+		return spec.Name
+	}
+	if len(spec.Tags) > 0 {
+		if named, err := reference.ParseNormalizedNamed(spec.Tags[0]); err == nil {
+			return reference.Path(named)
+		}
+	}
+	return fmt.Sprintf("build-%d", index+1)
+}
+
+// batchContextPath resolves a local context relative to the manifest
+func batchContextPath(baseDir string, context string) string {
+	if context == "" {
+		context = "."
+	}
+	if filepath.IsAbs(context) || urlutil.IsURL(context) || urlutil.IsGitURL(context) {
+		return context
+	}
+	return filepath.Join(baseDir, context)
+}
+
+// printBatchSummary of every build and fail when one of them failed, with
+// the class of the first failure
+func printBatchSummary(out io.Writer, results []batchResult) error {
+	var (
+		failed   int
+		firstErr error
+	)
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "BUILD\tIMAGE\tSTATUS\tDIGEST\tDURATION")
+	for _, result := range results {
+		status := "succeeded"
+		if result.err != nil {
+			status = fmt.Sprintf("failed (%s)", ClassOf(result.err))
+			failed++
+			if firstErr == nil {
+				firstErr = result.err
+			}
+		}
+		digest := result.digest
+		if digest == "" {
+			digest = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%v\n", result.name, result.image, status, digest, result.duration.Round(time.Second))
+	}
+	w.Flush()
+
+	if failed == 0 {
+		return nil
+	}
+	return withClass(ClassOf(firstErr), errors.Errorf("%d of %d builds failed", failed, len(results)))
+}
+
+// prefixWriter starts every line with the prefix. The writers of a batch
+// share the mutex so that lines of different builds do not mix.
+type prefixWriter struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	i := strings.LastIndexByte(string(w.buf), '\n')
+	if i < 0 {
+		return len(p), nil
+	}
+	lines := strings.SplitAfter(string(w.buf[:i+1]), "\n")
+	w.buf = append(w.buf[:0], w.buf[i+1:]...)
+
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		if _, err := io.WriteString(w.out, w.prefix+line); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush writes the last line even if it is not terminated
+func (w *prefixWriter) Flush() {
+	w.mu.Lock()
+	empty := len(w.buf) == 0
+	w.mu.Unlock()
+	if !empty {
+		w.Write([]byte("\n"))
+	}
+}
@@ -18,39 +18,56 @@
 package icrbuild
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"sync"
 
 	"github.com/IBM-Cloud/bluemix-go/api/container/registryv1"
+	"github.com/IBM-Cloud/bluemix-go/bmxerror"
 	"github.com/docker/cli/cli/command"
 	"github.com/docker/cli/cli/config/configfile"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
 // Builder to ise the standard Docker APIs to leverage standard CLI impementation
 type Builder struct {
 	client.APIClient
+	ctx            context.Context
 	registryClient *IBMRegistrySession
+	events         *eventLog
+	log            *logrus.Entry
+
+	mu     sync.Mutex
+	digest string
 }
 
+// builderCLI runs the docker CLI build command against client
 type builderCLI struct {
 	command.DockerCli
-	builder *Builder
+	client client.APIClient
 }
 
 // NewBuilder with the IBM Cloud Container Registry CLIs
-func NewBuilder(registryClient *IBMRegistrySession) *Builder {
+// Cancelling ctx aborts the context upload and the build stream
+func NewBuilder(ctx context.Context, registryClient *IBMRegistrySession) *Builder {
 	return &Builder{
+		ctx:            ctx,
 		registryClient: registryClient,
+		log:            logrus.NewEntry(logrus.StandardLogger()),
 	}
 }
 
 // ImageBuild satisfies the Docker Client interface for performing an image build
-func (o *Builder) ImageBuild(_ context.Context, buildctx io.Reader, opts types.ImageBuildOptions) (types.ImageBuildResponse, error) {
+func (o *Builder) ImageBuild(ctx context.Context, buildctx io.Reader, opts types.ImageBuildOptions) (types.ImageBuildResponse, error) {
 	var (
 		imageBuildRequest registryv1.ImageBuildRequest
 		buildArgBytes     []byte
@@ -65,6 +82,10 @@ func (o *Builder) ImageBuild(_ context.Context, buildctx io.Reader, opts types.I
 		tag = opts.Tags[0]
 	}
 
+	if _, err = o.registryClient.Refresh(); err != nil {
+		return buildResponse, newBuildError(ErrAuth, err)
+	}
+
 	if opts.BuildArgs != nil && len(opts.BuildArgs) > 0 {
 		buildArgBytes, err = json.Marshal(opts.BuildArgs)
 		if err != nil {
@@ -78,15 +99,73 @@ func (o *Builder) ImageBuild(_ context.Context, buildctx io.Reader, opts types.I
 		Buildargs:  fmt.Sprintf("%s", buildArgBytes),
 		Pull:       opts.PullParent,
 		Nocache:    opts.NoCache,
+		Quiet:      opts.SuppressOutput,
+		Squash:     opts.Squash,
+	}
+
+	// The context is spooled even for a single attempt, a 401 needs it sent again
+	replay, err := newReplayableContext(o.ctx, buildctx)
+	if err != nil {
+		if o.ctx.Err() != nil {
+			return buildResponse, newBuildError(ErrCancelled, err)
+		}
+		return buildResponse, newBuildError(ErrContext, err)
 	}
 
 	pr, pw = io.Pipe()
+	done := make(chan struct{})
 	go func() {
-		if err := o.registryClient.Builds.ImageBuild(imageBuildRequest, buildctx, o.registryClient.BuildTargetHeader, pw); err != nil {
-			pw.Write([]byte(fmt.Sprintf(`{"errorDetail":{"message":"%v"}}`, err)))
+		defer close(done)
+		defer replay.Close()
+		stream := &buildStream{out: pw, handler: o.inspect}
+		reauthenticated := false
+		err := o.registryClient.retry.withLog(o.log).Do(o.ctx, "Build request", func() error {
+			for {
+				apis, err := o.registryClient.Refresh()
+				if err != nil {
+					return err
+				}
+				body, err := replay.Reader()
+				if err != nil {
+					return permanentError{err}
+				}
+				body = newUploadReader(body, replay.Size(), o.events, o.log)
+				err = apis.Builds.ImageBuild(imageBuildRequest, body, o.registryClient.BuildTargetHeader, stream)
+				if err != nil && stream.written > 0 {
+					// The build already started, sending it again would build twice
+					return permanentError{err}
+				}
+				if !isUnauthorizedRequest(err) || reauthenticated {
+					return err
+				}
+				// The token was revoked or expired while the context was
+				// uploading, authenticate again and send the context once more
+				reauthenticated = true
+				o.log.Warnf("Build request was not authorized, renewing the IAM token and retrying: %v", err)
+				if authErr := o.registryClient.Reauthenticate(); authErr != nil {
+					return permanentError{errors.Wrapf(err, "Unable to renew the IAM token: %v", authErr)}
+				}
+			}
+		})
+		if err != nil {
+			if o.ctx.Err() != nil {
+				pw.CloseWithError(cancelledError(o.ctx))
+				return
+			}
+			writeErrorDetail(pw, err)
 		}
 		pw.Close()
 	}()
+	// The HTTP client aborts on the same context, closing the reader here
+	// stops the CLI from waiting on a stream that will never finish
+	go func() {
+		select {
+		case <-o.ctx.Done():
+			pr.CloseWithError(cancelledError(o.ctx))
+		case <-ctx.Done():
+		case <-done:
+		}
+	}()
 
 	buildResponse.Body = pr
 
@@ -94,13 +173,141 @@ func (o *Builder) ImageBuild(_ context.Context, buildctx io.Reader, opts types.I
 
 }
 
+// inspect records the details of interest from a build response message
+func (o *Builder) inspect(msg registryv1.ImageBuildResponse) {
+	o.events.buildResponse(msg)
+
+	// The push of the image reports its digest as aux data
+	if digest, ok := msg.Aux["Digest"].(string); ok && digest != "" {
+		o.mu.Lock()
+		o.digest = digest
+		o.mu.Unlock()
+	}
+}
+
+// Digest of the pushed image as reported by the build service, if any
+func (o *Builder) Digest() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.digest
+}
+
+// buildStream passes the build service response through to out and decodes
+// each newline delimited message for the handler
+type buildStream struct {
+	out     io.Writer
+	buf     []byte
+	written int64
+	handler func(registryv1.ImageBuildResponse)
+}
+
+func (s *buildStream) Write(p []byte) (int, error) {
+	n, err := s.out.Write(p)
+	s.written += int64(n)
+	s.buf = append(s.buf, p[:n]...)
+	for {
+		i := bytes.IndexByte(s.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := bytes.TrimSpace(s.buf[:i])
+		s.buf = s.buf[i+1:]
+		if len(line) == 0 {
+			continue
+		}
+		var msg registryv1.ImageBuildResponse
+		if json.Unmarshal(line, &msg) == nil {
+			s.handler(msg)
+		}
+	}
+	return n, err
+}
+
+// replayableContext spools the build context to a temporary file so that
+// the build request can be sent again after a transient failure or a 401
+type replayableContext struct {
+	file *os.File
+}
+
+// newReplayableContext spools buildctx until ctx is done
+func newReplayableContext(ctx context.Context, buildctx io.Reader) (*replayableContext, error) {
+	file, err := ioutil.TempFile("", "icrbuild-context-")
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to create a temporary file for the build context")
+	}
+	r := &replayableContext{file: file}
+	if _, err = io.Copy(file, &contextReader{ctx: ctx, r: buildctx}); err != nil {
+		r.Close()
+		return nil, errors.Wrap(err, "Unable to spool the build context")
+	}
+	return r, nil
+}
+
+// contextReader fails once ctx is done, so that a large context read from
+// stdin is not spooled to the end after a cancellation
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if r.ctx.Err() != nil {
+		return 0, cancelledError(r.ctx)
+	}
+	return r.r.Read(p)
+}
+
+// Reader of the context from the start
+func (r *replayableContext) Reader() (io.Reader, error) {
+	if _, err := r.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return r.file, nil
+}
+
+// Size of the spooled context, zero when it is not known
+func (r *replayableContext) Size() int64 {
+	info, err := r.file.Stat()
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// Close removes the spooled context
+func (r *replayableContext) Close() error {
+	r.file.Close()
+	return os.Remove(r.file.Name())
+}
+
+func cancelledError(ctx context.Context) error {
+	return errors.Wrap(ctx.Err(), "Build cancelled")
+}
+
+// writeErrorDetail reports an error from the build service in the stream so
+// that it surfaces as a cli.StatusError carrying the HTTP status code
+func writeErrorDetail(w io.Writer, err error) {
+	var code int
+	if reqErr, ok := errors.Cause(err).(bmxerror.RequestFailure); ok {
+		code = reqErr.StatusCode()
+	}
+	msg, merr := json.Marshal(jsonmessage.JSONMessage{
+		Error:        &jsonmessage.JSONError{Code: code, Message: err.Error()},
+		ErrorMessage: err.Error(),
+	})
+	if merr != nil {
+		return
+	}
+	w.Write(append(msg, '\n'))
+}
+
 // DaemonHost stub to Satisfy APIClient API (unused)
 func (o *Builder) DaemonHost() string {
 	return ""
 }
 
 func (b *builderCLI) Client() client.APIClient {
-	return b.builder
+	return b.client
 }
 
 func (b *builderCLI) ConfigFile() *configfile.ConfigFile {
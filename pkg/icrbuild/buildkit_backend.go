@@ -0,0 +1,210 @@
+// ------------------------------------------------------------------------------
+// Copyright IBM Corp. 2018
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ------------------------------------------------------------------------------
+
+// Package icrbuild ...
+package icrbuild
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/docker/cli/cli/command/image/build"
+	bkclient "github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/session/auth"
+	"github.com/moby/buildkit/session/auth/authprovider"
+	"github.com/moby/buildkit/util/appdefaults"
+	"github.com/moby/buildkit/util/progress/progressui"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+)
+
+// buildKitAddressEnvVar is the BuildKit daemon address used by buildctl
+const buildKitAddressEnvVar = "BUILDKIT_HOST"
+
+// buildKitBackend builds with the dockerfile frontend of a BuildKit daemon,
+// which pushes the image itself
+type buildKitBackend struct {
+	options        *BuildOptions
+	registryClient *IBMRegistrySession
+}
+
+func (b *buildKitBackend) Build(ctx context.Context, imageName string, contextDir string) (string, error) {
+	o := b.options
+	contextDir, relDockerfile, err := build.GetContextFromLocalDir(contextDir, o.Flags.File)
+	if err != nil {
+		return "", newBuildError(ErrContext, err)
+	}
+	if o.Flags.Squash {
+		o.log.Warnf("BuildKit does not support --squash, building without it")
+	}
+
+	address := buildKitAddress(o.Flags.BuildKitAddress)
+	c, err := bkclient.New(ctx, address)
+	if err != nil {
+		return "", newBuildError(ErrBuild, errors.Wrapf(err, "Unable to connect to BuildKit at %s", address))
+	}
+	defer c.Close()
+
+	dockerfile := filepath.Join(contextDir, relDockerfile)
+	opt := bkclient.SolveOpt{
+		Exporter: bkclient.ExporterImage,
+		ExporterAttrs: map[string]string{
+			"name": imageName,
+			"push": "true",
+		},
+		LocalDirs: map[string]string{
+			"context":    contextDir,
+			"dockerfile": filepath.Dir(dockerfile),
+		},
+		Frontend:      "dockerfile.v0",
+		FrontendAttrs: buildKitFrontendAttrs(o.Flags, filepath.Base(dockerfile)),
+		Session:       []session.Attachable{newRegistryAuthProvider(b.registryClient)},
+	}
+
+	statusChan := make(chan *bkclient.SolveStatus)
+	displayed := make(chan struct{})
+	go func() {
+		defer close(displayed)
+		// The events replace the progress of the build steps
+		if o.events.enabled() {
+			events := &solveEvents{events: o.events, started: map[string]bool{}, failed: map[string]bool{}}
+			for status := range statusChan {
+				events.handle(status)
+			}
+			return
+		}
+		var out io.Writer = o.Out
+		if o.Flags.Quiet {
+			out = ioutil.Discard
+		}
+		progressui.DisplaySolveStatus(ctx, nil, out, statusChan)
+		// Solve blocks until its status is read
+		for range statusChan {
+		}
+	}()
+
+	resp, err := c.Solve(ctx, nil, opt, statusChan)
+	<-displayed
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", newBuildError(ErrCancelled, cancelledError(ctx))
+		}
+		return "", newBuildError(ErrBuild, errors.Wrap(err, "BuildKit build failed"))
+	}
+	return resp.ExporterResponse["containerimage.digest"], nil
+}
+
+// buildKitStepRegexp matches the vertexes of the dockerfile frontend, such
+// as "[2/3] RUN make" or "[builder 2/3] RUN make"
+var buildKitStepRegexp = regexp.MustCompile(`^\[(?:[^\]]* )?(\d+)/(\d+)\] (.*)`)
+
+// solveEvents emits a step event when BuildKit starts a vertex and an error
+// event when one fails, the same events as the build service stream
+type solveEvents struct {
+	events  *eventLog
+	started map[string]bool
+	failed  map[string]bool
+}
+
+func (e *solveEvents) handle(status *bkclient.SolveStatus) {
+	for _, vertex := range status.Vertexes {
+		if vertex.Started != nil && !e.started[vertex.Digest.String()] {
+			e.started[vertex.Digest.String()] = true
+			event := Event{Type: EventStep, Phase: PhaseBuild, Message: vertex.Name}
+			if match := buildKitStepRegexp.FindStringSubmatch(vertex.Name); match != nil {
+				event.Step, _ = strconv.Atoi(match[1])
+				event.Steps, _ = strconv.Atoi(match[2])
+				event.Message = match[3]
+			}
+			e.events.emit(event)
+		}
+		if vertex.Error != "" && !e.failed[vertex.Digest.String()] {
+			e.failed[vertex.Digest.String()] = true
+			e.events.emit(Event{Type: EventError, Phase: PhaseBuild, Message: vertex.Name, Error: vertex.Error})
+		}
+	}
+}
+
+// buildKitAddress from the flag, BUILDKIT_HOST or the default socket
+func buildKitAddress(address string) string {
+	if address != "" {
+		return address
+	}
+	return envOrDefault(buildKitAddressEnvVar, appdefaults.Address)
+}
+
+// buildKitFrontendAttrs are the options of the dockerfile frontend that
+// match the flags of docker build
+func buildKitFrontendAttrs(flags BuildFlags, filename string) map[string]string {
+	attrs := map[string]string{"filename": filename}
+	for _, arg := range flags.BuildArgs {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) == 1 {
+			// As with docker build a bare KEY takes the value from the environment
+			value, ok := os.LookupEnv(kv[0])
+			if !ok {
+				continue
+			}
+			kv = append(kv, value)
+		}
+		attrs["build-arg:"+kv[0]] = kv[1]
+	}
+	if flags.NoCache {
+		attrs["no-cache"] = ""
+	}
+	if flags.Pull {
+		attrs["image-resolve-mode"] = "pull"
+	}
+	return attrs
+}
+
+// registryAuthProvider logs BuildKit in to the registry of the session with
+// its IAM token, other registries use the docker config
+type registryAuthProvider struct {
+	registryClient *IBMRegistrySession
+	fallback       auth.AuthServer
+}
+
+func newRegistryAuthProvider(registryClient *IBMRegistrySession) *registryAuthProvider {
+	p := &registryAuthProvider{registryClient: registryClient}
+	p.fallback, _ = authprovider.NewDockerAuthProvider().(auth.AuthServer)
+	return p
+}
+
+func (p *registryAuthProvider) Register(server *grpc.Server) {
+	auth.RegisterAuthServer(server, p)
+}
+
+func (p *registryAuthProvider) Credentials(ctx context.Context, req *auth.CredentialsRequest) (*auth.CredentialsResponse, error) {
+	if req.Host != p.registryClient.Registry {
+		if p.fallback == nil {
+			return &auth.CredentialsResponse{}, nil
+		}
+		return p.fallback.Credentials(ctx, req)
+	}
+	username, password, err := p.registryClient.RegistryCredentials()
+	if err != nil {
+		return nil, err
+	}
+	return &auth.CredentialsResponse{Username: username, Secret: password}, nil
+}
@@ -0,0 +1,168 @@
+// ------------------------------------------------------------------------------
+// Copyright IBM Corp. 2018
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ------------------------------------------------------------------------------
+
+// Package icrbuild ...
+package icrbuild
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/docker/cli/cli/command/image/build"
+	"github.com/docker/docker/pkg/fileutils"
+	"github.com/docker/go-units"
+	"github.com/pkg/errors"
+)
+
+// contextSizeReportLimit is how many files and directories to list when the
+// context is too big
+const contextSizeReportLimit = 10
+
+// localContext is a context directory as the docker CLI would send it
+type localContext struct {
+	Dir        string
+	Dockerfile string
+	Excludes   []string
+	Files      []contextFile
+	Size       int64
+}
+
+type contextFile struct {
+	Path string
+	Size int64
+}
+
+// listLocalContext resolves the context directory and Dockerfile the same
+// way the docker CLI does and lists the files left after .dockerignore
+func listLocalContext(contextPath string, dockerfile string) (*localContext, error) {
+	contextDir, relDockerfile, err := build.GetContextFromLocalDir(contextPath, dockerfile)
+	if err != nil {
+		return nil, err
+	}
+	excludes, err := build.ReadDockerignore(contextDir)
+	if err != nil {
+		return nil, err
+	}
+	local := &localContext{
+		Dir:        contextDir,
+		Dockerfile: relDockerfile,
+		Excludes:   build.TrimBuildFilesFromExcludes(excludes, relDockerfile, false),
+	}
+	local.Files, local.Size, err = contextFiles(contextDir, local.Excludes)
+	if err != nil {
+		return nil, err
+	}
+	return local, nil
+}
+
+// contextFiles lists the files of the context the same way the docker CLI
+// filters them with the .dockerignore excludes
+func contextFiles(contextDir string, excludes []string) ([]contextFile, int64, error) {
+	var (
+		files []contextFile
+		size  int64
+	)
+
+	pm, err := fileutils.NewPatternMatcher(excludes)
+	if err != nil {
+		return nil, 0, err
+	}
+	err = filepath.Walk(contextDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(contextDir, path)
+		if err != nil || relPath == "." {
+			return err
+		}
+		skip, err := pm.Matches(relPath)
+		if err != nil {
+			return err
+		}
+		if skip {
+			// Directories with exceptions below them must still be walked
+			if info.IsDir() && !pm.Exclusions() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() {
+			files = append(files, contextFile{Path: filepath.ToSlash(relPath), Size: info.Size()})
+			size += info.Size()
+		}
+		return nil
+	})
+	return files, size, err
+}
+
+// checkContextSize fails before anything is uploaded when the context is
+// bigger than --max-context-size, listing what takes up the space
+func (o *BuildOptions) checkContextSize(contextPath string) error {
+	if o.Flags.MaxContextSize == "" {
+		return nil
+	}
+	maxSize, err := units.RAMInBytes(o.Flags.MaxContextSize)
+	if err != nil {
+		return newBuildError(ErrUsage, errors.Wrapf(err, "Invalid maximum context size %s", o.Flags.MaxContextSize))
+	}
+
+	local, err := listLocalContext(contextPath, o.Flags.File)
+	if err != nil {
+		return newBuildError(ErrContext, err)
+	}
+	if local.Size <= maxSize {
+		return nil
+	}
+
+	o.log.Errorf("Biggest directories of the build context:")
+	for _, dir := range biggestDirectories(local.Files) {
+		o.log.Errorf("  %10s  %s/", units.BytesSize(float64(dir.Size)), dir.Path)
+	}
+	o.log.Errorf("Biggest files of the build context:")
+	for _, file := range biggestFiles(local.Files) {
+		o.log.Errorf("  %10s  %s", units.BytesSize(float64(file.Size)), file.Path)
+	}
+	return newBuildError(ErrContext, errors.Errorf("Build context %s is %s, more than the maximum of %s. Exclude files with .dockerignore", local.Dir, units.BytesSize(float64(local.Size)), units.BytesSize(float64(maxSize))))
+}
+
+func biggestFiles(files []contextFile) []contextFile {
+	sorted := append([]contextFile(nil), files...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Size > sorted[j].Size
+	})
+	if len(sorted) > contextSizeReportLimit {
+		sorted = sorted[:contextSizeReportLimit]
+	}
+	return sorted
+}
+
+// biggestDirectories by the total size of the files below them, only the
+// top level directories of the context are considered
+func biggestDirectories(files []contextFile) []contextFile {
+	sizes := map[string]int64{}
+	for _, file := range files {
+		if i := strings.Index(file.Path, "/"); i >= 0 {
+			sizes[file.Path[:i]] += file.Size
+		}
+	}
+	var dirs []contextFile
+	for path, size := range sizes {
+		dirs = append(dirs, contextFile{Path: path, Size: size})
+	}
+	return biggestFiles(dirs)
+}
@@ -0,0 +1,169 @@
+// ------------------------------------------------------------------------------
+// Copyright IBM Corp. 2018
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ------------------------------------------------------------------------------
+
+// Package icrbuild ...
+package icrbuild
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/IBM-Cloud/bluemix-go/api/container/registryv1"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+)
+
+// dockerBackend builds with the docker daemon of DOCKER_HOST and pushes
+// the image, to reproduce a build locally
+type dockerBackend struct {
+	options        *BuildOptions
+	registryClient *IBMRegistrySession
+}
+
+func (b *dockerBackend) Build(ctx context.Context, imageName string, contextDir string) (string, error) {
+	o := b.options
+	daemon, err := client.NewEnvClient()
+	if err != nil {
+		return "", newBuildError(ErrBuild, errors.Wrap(err, "Unable to connect to the docker daemon"))
+	}
+	defer daemon.Close()
+	daemon.NegotiateAPIVersion(ctx)
+
+	pushing := &pushingClient{APIClient: daemon, ctx: ctx, registryClient: b.registryClient, events: o.events}
+	ccmd := o.newDockerBuildCommand(pushing, imageName)
+	err = ccmd.RunE(nil, []string{contextDir})
+	return pushing.Digest(), err
+}
+
+// pushingClient pushes the image once the daemon has built it, the push is
+// streamed after the build so the docker CLI renders both
+type pushingClient struct {
+	client.APIClient
+	ctx            context.Context
+	registryClient *IBMRegistrySession
+	events         *eventLog
+
+	mu     sync.Mutex
+	failed bool
+	digest string
+}
+
+// ImageBuild builds with the daemon, logged in to the registry so that
+// base images can be pulled from it too
+func (c *pushingClient) ImageBuild(ctx context.Context, buildctx io.Reader, opts types.ImageBuildOptions) (types.ImageBuildResponse, error) {
+	authConfig, err := c.authConfig()
+	if err != nil {
+		return types.ImageBuildResponse{}, newBuildError(ErrAuth, err)
+	}
+	authConfigs := map[string]types.AuthConfig{c.registryClient.Registry: authConfig}
+	for host, config := range opts.AuthConfigs {
+		authConfigs[host] = config
+	}
+	opts.AuthConfigs = authConfigs
+
+	resp, err := c.APIClient.ImageBuild(ctx, buildctx, opts)
+	if err != nil {
+		if ctx.Err() != nil {
+			return resp, newBuildError(ErrCancelled, err)
+		}
+		// The context is packed by now, this is the daemon failing
+		return resp, newBuildError(ErrBuild, err)
+	}
+
+	body := resp.Body
+	pr, pw := io.Pipe()
+	go func() {
+		defer body.Close()
+		if _, err := io.Copy(&buildStream{out: pw, handler: c.inspect}, body); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if c.buildFailed() || len(opts.Tags) == 0 {
+			// The docker CLI reports the error from the stream
+			pw.Close()
+			return
+		}
+		if err := c.push(opts.Tags[0], pw); err != nil {
+			writeErrorDetail(pw, err)
+		}
+		pw.Close()
+	}()
+	resp.Body = pr
+	return resp, nil
+}
+
+func (c *pushingClient) push(imageName string, out io.Writer) error {
+	authConfig, err := c.authConfig()
+	if err != nil {
+		return newBuildError(ErrAuth, err)
+	}
+	encoded, err := json.Marshal(authConfig)
+	if err != nil {
+		return err
+	}
+	stream, err := c.APIClient.ImagePush(c.ctx, imageName, types.ImagePushOptions{
+		RegistryAuth: base64.URLEncoding.EncodeToString(encoded),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Unable to push %s", imageName)
+	}
+	defer stream.Close()
+	_, err = io.Copy(&buildStream{out: out, handler: c.inspect}, stream)
+	return err
+}
+
+func (c *pushingClient) authConfig() (types.AuthConfig, error) {
+	username, password, err := c.registryClient.RegistryCredentials()
+	if err != nil {
+		return types.AuthConfig{}, err
+	}
+	return types.AuthConfig{
+		Username:      username,
+		Password:      password,
+		ServerAddress: c.registryClient.Registry,
+	}, nil
+}
+
+// inspect records a failed build and the digest reported by the push
+func (c *pushingClient) inspect(msg registryv1.ImageBuildResponse) {
+	c.events.buildResponse(msg)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if msg.Error != "" || msg.ErrorDetail.Message != "" {
+		c.failed = true
+	}
+	if digest, ok := msg.Aux["Digest"].(string); ok && digest != "" {
+		c.digest = digest
+	}
+}
+
+func (c *pushingClient) buildFailed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.failed
+}
+
+// Digest of the pushed image, if any
+func (c *pushingClient) Digest() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.digest
+}
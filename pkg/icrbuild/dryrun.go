@@ -0,0 +1,181 @@
+// ------------------------------------------------------------------------------
+// Copyright IBM Corp. 2018
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ------------------------------------------------------------------------------
+
+// Package icrbuild ...
+package icrbuild
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	ibmcloud "github.com/IBM-Cloud/bluemix-go"
+	"github.com/docker/go-units"
+	"github.com/pkg/errors"
+)
+
+// Output formats
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+)
+
+// DryRunReport is what a build would send to the build service
+type DryRunReport struct {
+	Backend     string   `json:"backend"`
+	Registry    string   `json:"registry"`
+	Region      string   `json:"region"`
+	Credentials string   `json:"credentials"`
+	Account     string   `json:"account,omitempty"`
+	Images      []string `json:"images"`
+	Context     string   `json:"context"`
+	Dockerfile  string   `json:"dockerfile"`
+	// BuildArgs are only the names, the values are often secrets
+	BuildArgs   []string `json:"buildArgs"`
+	Excludes    []string `json:"excludes"`
+	Files       []string `json:"files"`
+	ContextSize int64    `json:"contextSize"`
+}
+
+// validateOutput checks the --output flag
+func (o *BuildOptions) validateOutput() error {
+	switch o.Flags.Output {
+	case "", OutputText, OutputJSON:
+		return nil
+	}
+	return errors.Errorf("Unknown output format %s, expected %s or %s", o.Flags.Output, OutputText, OutputJSON)
+}
+
+// dryRun resolves everything a build would use without authenticating or
+// uploading, and prints it
+func (o *BuildOptions) dryRun(contextPath string) error {
+	report, err := o.newDryRunReport(contextPath)
+	if err != nil {
+		return err
+	}
+	if o.Flags.Output == OutputJSON {
+		encoder := json.NewEncoder(o.Out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+	report.print(o.Out)
+	return nil
+}
+
+func (o *BuildOptions) newDryRunReport(contextPath string) (*DryRunReport, error) {
+	var imageRegistry string
+	if endpoint := getRegistryEndpoint(o.Flags.Tags[0]); endpoint != nil {
+		imageRegistry = *endpoint
+	}
+	opts := o.sessionOptions()
+	registry, region, err := resolveRegistry(imageRegistry, opts)
+	if err != nil {
+		return nil, newBuildError(ErrUsage, err)
+	}
+
+	backend := o.Flags.Backend
+	if backend == "" {
+		backend = BackendRemote
+	}
+	report := &DryRunReport{
+		Backend:   backend,
+		Registry:  registry,
+		Region:    region,
+		BuildArgs: buildArgNames(o.Flags.BuildArgs),
+	}
+	for _, tag := range o.Flags.Tags {
+		imageName, err := qualifyImageName(registry, tag)
+		if err != nil {
+			return nil, newBuildError(ErrUsage, err)
+		}
+		report.Images = append(report.Images, imageName)
+	}
+	report.Credentials, report.Account = describeCredentials(DefaultCredentialProviders(opts), registry)
+
+	localContext, err := listLocalContext(contextPath, o.Flags.File)
+	if err != nil {
+		return nil, newBuildError(ErrContext, err)
+	}
+	report.Context = localContext.Dir
+	report.Dockerfile = localContext.Dockerfile
+	report.Excludes = localContext.Excludes
+	report.ContextSize = localContext.Size
+	for _, file := range localContext.Files {
+		report.Files = append(report.Files, file.Path)
+	}
+	return report, nil
+}
+
+// buildArgNames drops the values of KEY=VALUE build args
+func buildArgNames(buildArgs []string) []string {
+	var names []string
+	for _, arg := range buildArgs {
+		names = append(names, strings.SplitN(arg, "=", 2)[0])
+	}
+	return names
+}
+
+// describeCredentials names the provider a build would use and the account if
+// it is known without calling IAM. The trusted profile exchange needs IAM so
+// it is only named.
+func describeCredentials(providers []CredentialProvider, registry string) (string, string) {
+	for _, provider := range providers {
+		if profile, ok := provider.(*trustedProfileProvider); ok {
+			if profile.profile != "" {
+				return provider.Name(), ""
+			}
+			continue
+		}
+		config := &ibmcloud.Config{}
+		accountID, ok, err := provider.Retrieve(config, registry)
+		if err != nil {
+			return fmt.Sprintf("%s (unusable: %v)", provider.Name(), err), ""
+		}
+		if ok {
+			if accountID == "" {
+				accountID = tokenAccount(config.IAMAccessToken)
+			}
+			return provider.Name(), accountID
+		}
+	}
+	return "none", ""
+}
+
+func (r *DryRunReport) print(out io.Writer) {
+	account := r.Account
+	if account == "" {
+		account = "unknown until authenticated"
+	}
+	fmt.Fprintf(out, "Backend:      %s\n", r.Backend)
+	fmt.Fprintf(out, "Registry:     %s\n", r.Registry)
+	fmt.Fprintf(out, "Region:       %s\n", r.Region)
+	fmt.Fprintf(out, "Credentials:  %s\n", r.Credentials)
+	fmt.Fprintf(out, "Account:      %s\n", account)
+	fmt.Fprintf(out, "Images:       %s\n", strings.Join(r.Images, "\n              "))
+	fmt.Fprintf(out, "Context:      %s\n", r.Context)
+	fmt.Fprintf(out, "Dockerfile:   %s\n", r.Dockerfile)
+	if len(r.BuildArgs) > 0 {
+		fmt.Fprintf(out, "Build args:   %s\n", strings.Join(r.BuildArgs, "\n              "))
+	}
+	if len(r.Excludes) > 0 {
+		fmt.Fprintf(out, "Excludes:     %s\n", strings.Join(r.Excludes, "\n              "))
+	}
+	fmt.Fprintf(out, "Files:        %d, %s\n", len(r.Files), units.BytesSize(float64(r.ContextSize)))
+	for _, file := range r.Files {
+		fmt.Fprintf(out, "  %s\n", file)
+	}
+}
@@ -0,0 +1,200 @@
+// ------------------------------------------------------------------------------
+// Copyright IBM Corp. 2018
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ------------------------------------------------------------------------------
+
+// Package icrbuild ...
+package icrbuild
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/IBM-Cloud/bluemix-go/bmxerror"
+	"github.com/docker/cli/cli"
+	"github.com/pkg/errors"
+)
+
+// ErrorClass categorizes a build failure so that callers can react to it
+type ErrorClass int
+
+const (
+	// ErrGeneric is a failure that does not fit any other class
+	ErrGeneric ErrorClass = iota
+	// ErrUsage is an invalid flag or argument
+	ErrUsage
+	// ErrAuth is a failure to authenticate with IBM Cloud
+	ErrAuth
+	// ErrContext is a failure to read or pack the build context
+	ErrContext
+	// ErrBuild is a failure reported by the remote build service
+	ErrBuild
+	// ErrQuota is an exceeded registry storage or traffic quota
+	ErrQuota
+	// ErrNamespace is a missing or inaccessible registry namespace
+	ErrNamespace
+	// ErrCancelled is a build interrupted by a signal or the timeout
+	ErrCancelled
+	// ErrPolicy is an image that violates the Vulnerability Advisor policy
+	ErrPolicy
+)
+
+var errorClassNames = map[ErrorClass]string{
+	ErrGeneric:   "generic",
+	ErrUsage:     "usage",
+	ErrAuth:      "auth",
+	ErrContext:   "context",
+	ErrBuild:     "build",
+	ErrQuota:     "quota",
+	ErrNamespace: "namespace",
+	ErrCancelled: "cancelled",
+	ErrPolicy:    "policy",
+}
+
+// Exit codes are part of the CLI contract, do not renumber
+var errorClassExitCodes = map[ErrorClass]int{
+	ErrGeneric:   1,
+	ErrUsage:     2,
+	ErrAuth:      3,
+	ErrContext:   4,
+	ErrBuild:     5,
+	ErrQuota:     6,
+	ErrNamespace: 7,
+	ErrCancelled: 8,
+	ErrPolicy:    9,
+}
+
+func (c ErrorClass) String() string {
+	if name, ok := errorClassNames[c]; ok {
+		return name
+	}
+	return errorClassNames[ErrGeneric]
+}
+
+// ExitCode for the error class
+func (c ErrorClass) ExitCode() int {
+	if code, ok := errorClassExitCodes[c]; ok {
+		return code
+	}
+	return errorClassExitCodes[ErrGeneric]
+}
+
+// BuildError is an error tagged with the class of failure
+type BuildError struct {
+	Class ErrorClass
+	Err   error
+}
+
+func newBuildError(class ErrorClass, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &BuildError{Class: class, Err: err}
+}
+
+// UsageError tags err as an invalid flag or argument
+func UsageError(err error) error {
+	return newBuildError(ErrUsage, err)
+}
+
+// withClass tags err with class unless it already carries one
+func withClass(class ErrorClass, err error) error {
+	if err == nil || ClassOf(err) != ErrGeneric {
+		return err
+	}
+	return newBuildError(class, err)
+}
+
+func (e *BuildError) Error() string {
+	return e.Err.Error()
+}
+
+// Cause satisfies the github.com/pkg/errors causer interface
+func (e *BuildError) Cause() error {
+	return e.Err
+}
+
+// ExitCode the process should terminate with for this error
+func (e *BuildError) ExitCode() int {
+	return e.Class.ExitCode()
+}
+
+// ClassOf returns the class of the first BuildError in the chain of causes
+func ClassOf(err error) ErrorClass {
+	for err != nil {
+		if buildErr, ok := err.(*BuildError); ok {
+			return buildErr.Class
+		}
+		causer, ok := err.(interface{ Cause() error })
+		if !ok {
+			break
+		}
+		err = causer.Cause()
+	}
+	return ErrGeneric
+}
+
+// ExitCode maps an error returned by a build to a process exit code
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	return ClassOf(err).ExitCode()
+}
+
+// classifyBuildError sorts an error returned by the docker build command.
+// Errors reported through the errorDetail stream come back as a
+// cli.StatusError, cancellation closes the stream with the context error.
+// The backends classify the errors of their daemon, anything else left
+// happened while the docker CLI packed the context.
+func classifyBuildError(err error) error {
+	if err == nil || ClassOf(err) != ErrGeneric {
+		return err
+	}
+	if cause := errors.Cause(err); cause == context.Canceled || cause == context.DeadlineExceeded {
+		return newBuildError(ErrCancelled, err)
+	}
+	statusErr, ok := err.(cli.StatusError)
+	if !ok {
+		return newBuildError(ErrContext, err)
+	}
+	return newBuildError(classifyBuildMessage(statusErr.StatusCode, statusErr.Status), err)
+}
+
+// isUnauthorizedRequest reports whether a request to the registry was
+// rejected with a 401
+func isUnauthorizedRequest(err error) bool {
+	reqErr, ok := errors.Cause(err).(bmxerror.RequestFailure)
+	return ok && reqErr.StatusCode() == http.StatusUnauthorized
+}
+
+// isNotFoundRequest reports whether a request to the registry failed with a 404
+func isNotFoundRequest(err error) bool {
+	reqErr, ok := errors.Cause(err).(bmxerror.RequestFailure)
+	return ok && reqErr.StatusCode() == http.StatusNotFound
+}
+
+func classifyBuildMessage(code int, message string) ErrorClass {
+	message = strings.ToLower(message)
+	switch {
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return ErrAuth
+	case strings.Contains(message, "quota"):
+		return ErrQuota
+	case strings.Contains(message, "namespace"):
+		return ErrNamespace
+	}
+	return ErrBuild
+}
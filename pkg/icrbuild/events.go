@@ -0,0 +1,219 @@
+// ------------------------------------------------------------------------------
+// Copyright IBM Corp. 2018
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ------------------------------------------------------------------------------
+
+// Package icrbuild ...
+package icrbuild
+
+import (
+	"encoding/json"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IBM-Cloud/bluemix-go/api/container/registryv1"
+	"github.com/docker/go-units"
+	"github.com/sirupsen/logrus"
+)
+
+// Event types emitted with --output json
+const (
+	EventPhaseStarted  = "phase-started"
+	EventPhaseFinished = "phase-finished"
+	EventUpload        = "upload"
+	EventStep          = "step"
+	EventTag           = "tag"
+	EventScan          = "scan"
+	EventDelete        = "delete"
+	EventError         = "error"
+	EventResult        = "result"
+)
+
+// Build phases
+const (
+	PhaseFetch        = "fetch"
+	PhaseAuthenticate = "authenticate"
+	PhasePreflight    = "preflight"
+	PhaseBuild        = "build"
+	PhaseTag          = "tag"
+	PhaseScan         = "scan"
+	PhaseResults      = "results"
+	PhaseCleanup      = "cleanup"
+)
+
+// Limits on how often upload progress is reported
+const (
+	uploadEventInterval = time.Second
+	uploadLogInterval   = 5 * time.Second
+)
+
+var buildStepRegexp = regexp.MustCompile(`^Step (\d+)/(\d+) : (.*)`)
+
+// Event is one line of the --output json stream
+type Event struct {
+	Time     time.Time   `json:"time"`
+	Type     string      `json:"type"`
+	Phase    string      `json:"phase,omitempty"`
+	Message  string      `json:"message,omitempty"`
+	Image    string      `json:"image,omitempty"`
+	Digest   string      `json:"digest,omitempty"`
+	Step     int         `json:"step,omitempty"`
+	Steps    int         `json:"steps,omitempty"`
+	Bytes    int64       `json:"bytes,omitempty"`
+	Total    int64       `json:"total,omitempty"`
+	Rate     float64     `json:"bytesPerSecond,omitempty"`
+	ETA      float64     `json:"etaSeconds,omitempty"`
+	Duration float64     `json:"durationSeconds,omitempty"`
+	Error    string      `json:"error,omitempty"`
+	Class    string      `json:"class,omitempty"`
+	ExitCode int         `json:"exitCode,omitempty"`
+	Data     interface{} `json:"data,omitempty"`
+}
+
+// eventLog writes events as JSON lines, a nil eventLog discards them
+type eventLog struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+func newEventLog(out io.Writer) *eventLog {
+	return &eventLog{encoder: json.NewEncoder(out)}
+}
+
+// enabled reports whether events are written, the text output is used otherwise
+func (l *eventLog) enabled() bool {
+	return l != nil
+}
+
+func (l *eventLog) emit(event Event) {
+	if l == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.encoder.Encode(event)
+}
+
+// phase emits the start of a phase and returns the function that emits its end
+func (l *eventLog) phase(name string) func(err error) {
+	if l == nil {
+		return func(error) {}
+	}
+	start := time.Now()
+	l.emit(Event{Type: EventPhaseStarted, Phase: name})
+	return func(err error) {
+		event := Event{Type: EventPhaseFinished, Phase: name, Duration: time.Since(start).Seconds()}
+		if err != nil {
+			event.Error = err.Error()
+		}
+		l.emit(event)
+	}
+}
+
+// errorEvent reports the error a build failed with
+func (l *eventLog) errorEvent(err error) {
+	class := ClassOf(err)
+	l.emit(Event{Type: EventError, Error: err.Error(), Class: class.String(), ExitCode: class.ExitCode()})
+}
+
+// buildResponse emits the remote build steps and errors of the build stream
+func (l *eventLog) buildResponse(msg registryv1.ImageBuildResponse) {
+	if l == nil {
+		return
+	}
+	if match := buildStepRegexp.FindStringSubmatch(strings.TrimSpace(msg.Stream)); match != nil {
+		step, _ := strconv.Atoi(match[1])
+		steps, _ := strconv.Atoi(match[2])
+		l.emit(Event{Type: EventStep, Phase: PhaseBuild, Step: step, Steps: steps, Message: match[3]})
+	}
+	if msg.Error != "" {
+		l.emit(Event{Type: EventError, Phase: PhaseBuild, Error: msg.Error})
+	}
+}
+
+// uploadReader reports the progress of the context upload, as events with
+// --output json and in the log otherwise
+type uploadReader struct {
+	reader io.Reader
+	events *eventLog
+	log    *logrus.Entry
+	total  int64
+	bytes  int64
+	start  time.Time
+	last   time.Time
+	done   bool
+}
+
+func newUploadReader(reader io.Reader, total int64, events *eventLog, log *logrus.Entry) *uploadReader {
+	now := time.Now()
+	return &uploadReader{reader: reader, events: events, log: log, total: total, start: now, last: now}
+}
+
+func (r *uploadReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.bytes += int64(n)
+	if r.done {
+		return n, err
+	}
+
+	interval := uploadLogInterval
+	if r.events.enabled() {
+		interval = uploadEventInterval
+	}
+	if err != io.EOF && time.Since(r.last) < interval {
+		return n, err
+	}
+	r.done = err == io.EOF
+	r.last = time.Now()
+	r.report()
+	return n, err
+}
+
+func (r *uploadReader) report() {
+	elapsed := time.Since(r.start)
+	var rate float64
+	if elapsed > 0 {
+		rate = float64(r.bytes) / elapsed.Seconds()
+	}
+	var eta time.Duration
+	if rate > 0 && r.total > r.bytes {
+		eta = time.Duration(float64(r.total-r.bytes) / rate * float64(time.Second))
+	}
+
+	if r.events.enabled() {
+		event := Event{Type: EventUpload, Phase: PhaseBuild, Bytes: r.bytes, Total: r.total, Rate: rate, ETA: eta.Seconds()}
+		if r.done {
+			event.Message = "complete"
+			event.Duration = elapsed.Seconds()
+		}
+		r.events.emit(event)
+		return
+	}
+
+	switch {
+	case r.done:
+		r.log.Infof("Uploaded build context, %s in %v (%s/s)", units.BytesSize(float64(r.bytes)), elapsed.Round(time.Second), units.BytesSize(rate))
+	case r.total > 0:
+		r.log.Infof("Uploading build context, %s of %s (%s/s, %v left)", units.BytesSize(float64(r.bytes)), units.BytesSize(float64(r.total)), units.BytesSize(rate), eta.Round(time.Second))
+	default:
+		r.log.Infof("Uploading build context, %s (%s/s)", units.BytesSize(float64(r.bytes)), units.BytesSize(rate))
+	}
+}
@@ -0,0 +1,218 @@
+// ------------------------------------------------------------------------------
+// Copyright IBM Corp. 2018
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ------------------------------------------------------------------------------
+
+// Package icrbuild ...
+package icrbuild
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	ibmcloud "github.com/IBM-Cloud/bluemix-go"
+	"github.com/IBM-Cloud/bluemix-go/authentication"
+	"github.com/IBM-Cloud/bluemix-go/bmxerror"
+	"github.com/IBM-Cloud/bluemix-go/endpoints"
+	"github.com/IBM-Cloud/bluemix-go/rest"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultCRTokenFile is where IKS projects the service account token for IAM
+	DefaultCRTokenFile = "/var/run/secrets/tokens/sa-token"
+
+	crTokenGrantType = "urn:ibm:params:oauth:grant-type:cr-token"
+	bearerPrefix     = "Bearer "
+)
+
+// tokenRenewer is implemented by credential providers that issue IAM
+// access tokens without a refresh token, they are renewed by repeating
+// the exchange that produced them
+type tokenRenewer interface {
+	RenewToken(config *ibmcloud.Config) error
+}
+
+// trustedProfileProvider exchanges a compute resource token, such as the
+// projected service account token of an IKS pod, for an IAM access token of
+// a trusted profile
+type trustedProfileProvider struct {
+	profile   string
+	tokenFile string
+}
+
+func (p *trustedProfileProvider) Name() string {
+	return fmt.Sprintf("trusted profile %s with compute resource token %s", p.profile, p.tokenFile)
+}
+
+func (p *trustedProfileProvider) Retrieve(config *ibmcloud.Config, _ string) (string, bool, error) {
+	if p.profile == "" {
+		return "", false, nil
+	}
+	if err := p.RenewToken(config); err != nil {
+		return "", false, err
+	}
+	setTokenOnlyCredentials(config)
+	return tokenAccount(config.IAMAccessToken), true, nil
+}
+
+// RenewToken re-reads the compute resource token, which the kubelet rotates,
+// and exchanges it again
+func (p *trustedProfileProvider) RenewToken(config *ibmcloud.Config) error {
+	crToken, err := readTokenFile(p.tokenFile)
+	if err != nil {
+		return err
+	}
+
+	iamEndpoint, err := endpoints.NewEndpointLocator(config.Region).IAMEndpoint()
+	if err != nil {
+		return err
+	}
+
+	request := rest.PostRequest(iamEndpoint+"/identity/token").
+		Field("grant_type", crTokenGrantType).
+		Field("cr_token", crToken)
+	if strings.HasPrefix(p.profile, "crn:") {
+		request.Field("profile_crn", p.profile)
+	} else {
+		request.Field("profile_id", p.profile)
+	}
+
+	var (
+		tokens authentication.IAMTokenResponse
+		apiErr authentication.IAMError
+	)
+	resp, err := (&rest.Client{HTTPClient: config.HTTPClient}).Do(request, &tokens, &apiErr)
+	if err != nil {
+		return err
+	}
+	if apiErr.ErrorCode != "" {
+		return bmxerror.NewRequestFailure(apiErr.ErrorCode, apiErr.Description(), resp.StatusCode)
+	}
+	config.IAMAccessToken = fmt.Sprintf("%s %s", tokens.TokenType, tokens.AccessToken)
+	config.IAMRefreshToken = ""
+	return nil
+}
+
+// iamTokenFileProvider uses an IAM access token that is kept up to date in a
+// file by something else, for example a sidecar
+type iamTokenFileProvider struct {
+	path string
+}
+
+func (p *iamTokenFileProvider) Name() string {
+	return fmt.Sprintf("IAM token file %s", p.path)
+}
+
+func (p *iamTokenFileProvider) Retrieve(config *ibmcloud.Config, _ string) (string, bool, error) {
+	if p.path == "" {
+		return "", false, nil
+	}
+	if err := p.RenewToken(config); err != nil {
+		return "", false, err
+	}
+	setTokenOnlyCredentials(config)
+	return tokenAccount(config.IAMAccessToken), true, nil
+}
+
+// RenewToken reads the file again
+func (p *iamTokenFileProvider) RenewToken(config *ibmcloud.Config) error {
+	token, err := readTokenFile(p.path)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(token, bearerPrefix) {
+		token = bearerPrefix + token
+	}
+	config.IAMAccessToken = token
+	config.IAMRefreshToken = ""
+	return nil
+}
+
+// setTokenOnlyCredentials satisfies the bluemix-go configuration checks for
+// a config that only holds an access token, as done for the CLI session
+func setTokenOnlyCredentials(config *ibmcloud.Config) {
+	config.BluemixAPIKey = na
+	config.IBMID = na
+	config.IBMIDPassword = na
+}
+
+func readTokenFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", errors.Errorf("Token file %s is empty", path)
+	}
+	return token, nil
+}
+
+// tokenClaims of an IAM access token that are of interest
+type tokenClaims struct {
+	Expiry  int64 `json:"exp"`
+	Account struct {
+		Bss string `json:"bss"`
+	} `json:"account"`
+}
+
+// parseToken decodes the claims of an IAM access token without verifying it,
+// the token is only inspected, IAM and the registry do the verification
+func parseToken(token string) (*tokenClaims, error) {
+	segments := strings.Split(strings.TrimPrefix(token, bearerPrefix), ".")
+	if len(segments) != 3 {
+		return nil, errors.New("IAM token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segments[1], "="))
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid IAM token payload")
+	}
+	claims := new(tokenClaims)
+	if err = json.Unmarshal(payload, claims); err != nil {
+		return nil, errors.Wrap(err, "Invalid IAM token claims")
+	}
+	return claims, nil
+}
+
+// tokenAccount is the account the token was issued for, empty if unknown
+func tokenAccount(token string) string {
+	claims, err := parseToken(token)
+	if err != nil {
+		return ""
+	}
+	return claims.Account.Bss
+}
+
+// tokenExpiry is the time the token expires, zero if unknown
+func tokenExpiry(token string) time.Time {
+	claims, err := parseToken(token)
+	if err != nil || claims.Expiry == 0 {
+		return time.Time{}
+	}
+	return time.Unix(claims.Expiry, 0)
+}
+
+// envOrDefault returns the environment variable or def when it is unset
+func envOrDefault(name string, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
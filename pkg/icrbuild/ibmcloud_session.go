@@ -18,6 +18,7 @@
 package icrbuild
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
@@ -29,14 +30,20 @@ import (
 	"io/ioutil"
 	"net/url"
 	"os"
+	"path/filepath"
+	"sync"
 
 	"github.com/sirupsen/logrus"
 
 	ibmcloud "github.com/IBM-Cloud/bluemix-go"
 	"github.com/IBM-Cloud/bluemix-go/api/container/registryv1"
 	"github.com/IBM-Cloud/bluemix-go/api/iam/iamv1"
-	"github.com/IBM-Cloud/bluemix-go/endpoints"
+	"github.com/IBM-Cloud/bluemix-go/authentication"
+	bmxhttp "github.com/IBM-Cloud/bluemix-go/http"
+	"github.com/IBM-Cloud/bluemix-go/rest"
 	"github.com/IBM-Cloud/bluemix-go/session"
+	"github.com/docker/docker-credential-helpers/client"
+	"github.com/docker/docker-credential-helpers/credentials"
 	"github.com/pkg/errors"
 
 	"strings"
@@ -44,11 +51,30 @@ import (
 
 const na = "n/a"
 
+// tokenRefreshMargin before the expiry of the IAM token to renew it
+const tokenRefreshMargin = 5 * time.Minute
+
 // IBMRegistrySession structure
 type IBMRegistrySession struct {
 	Registry          string
-	Builds            registryv1.Builds
 	BuildTargetHeader registryv1.BuildTargetHeader
+
+	mu     sync.Mutex
+	apis   RegistryAPIs
+	ctx    context.Context
+	retry  RetryPolicy
+	config *ibmcloud.Config
+	expiry time.Time
+	renew  func(*ibmcloud.Config) error
+}
+
+// RegistryAPIs created with the IAM token of a session. They are replaced
+// when the token is renewed, so they are only returned as a snapshot.
+type RegistryAPIs struct {
+	Builds      registryv1.Builds
+	Images      registryv1.Images
+	Namespaces  registryv1.Namespaces
+	RegistryAPI RegistryAPI
 }
 
 type configJSON struct {
@@ -71,17 +97,39 @@ type entry struct {
 }
 
 type dockerConfig struct {
-	Entries map[string]entry `json:"auths"`
+	Entries     map[string]entry  `json:"auths"`
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
 }
 
-// NewHTTPClient ...
-func NewHTTPClient(config *ibmcloud.Config) *http.Client {
+// NewHTTPClient for requests that are aborted when ctx is done
+// The overall request timeout is taken from config.HTTPTimeout, zero means none
+// Requests are logged at trace level
+func NewHTTPClient(ctx context.Context, config *ibmcloud.Config) *http.Client {
+	transport := makeTransport(config)
+	if logrus.IsLevelEnabled(logrus.TraceLevel) {
+		transport = &traceTransport{transport}
+	}
 	return &http.Client{
-		Transport: makeTransport(config),
-		Timeout:   config.HTTPTimeout,
+		Transport: &contextTransport{
+			ctx:          ctx,
+			RoundTripper: transport,
+		},
+		Timeout: config.HTTPTimeout,
 	}
 }
 
+// contextTransport binds requests to a context since the bluemix-go
+// rest client builds them without one
+type contextTransport struct {
+	http.RoundTripper
+	ctx context.Context
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.RoundTripper.RoundTrip(req.WithContext(t.ctx))
+}
+
 func makeTransport(config *ibmcloud.Config) http.RoundTripper {
 	return &http.Transport{
 		Proxy: http.ProxyFromEnvironment,
@@ -97,71 +145,231 @@ func makeTransport(config *ibmcloud.Config) http.RoundTripper {
 	}
 }
 
+// SessionOptions configure how NewRegistryClient connects to IBM Cloud
+type SessionOptions struct {
+	// Timeout for each request, zero means no timeout
+	Timeout time.Duration
+	// Region to build in, IBMCLOUD_REGION is used when empty
+	Region string
+	// Registry host to use when the image name has none
+	Registry string
+	// APIKeyFile holds an API key, typically a mounted secret
+	APIKeyFile string
+	// TrustedProfile ID or CRN to assume with the compute resource token in CRTokenFile
+	TrustedProfile string
+	CRTokenFile    string
+	// IAMTokenFile holds an IAM access token that is kept up to date externally
+	IAMTokenFile string
+	// CredentialProviders to try in order, DefaultCredentialProviders when nil
+	CredentialProviders []CredentialProvider
+	// Retry of the IAM and build requests, DefaultRetryPolicy when MaxAttempts is zero
+	Retry RetryPolicy
+}
+
+// CredentialProvider supplies the IBM Cloud credentials for a session
+type CredentialProvider interface {
+	// Name describes where the credentials come from, it must not contain secrets
+	Name() string
+	// Retrieve sets the credentials on config and returns the account ID if known.
+	// ok is false when the provider has no credentials for the registry.
+	Retrieve(config *ibmcloud.Config, registry string) (accountID string, ok bool, err error)
+}
+
+// DefaultCredentialProviders in order of precedence:
+//  1. the API key in opts.APIKeyFile, when set
+//  2. the trusted profile in opts.TrustedProfile or IBMCLOUD_TRUSTED_PROFILE_ID,
+//     assumed with the compute resource token in opts.CRTokenFile,
+//     IBMCLOUD_CR_TOKEN_FILE or DefaultCRTokenFile
+//  3. the IAM access token in opts.IAMTokenFile, when set
+//  4. the IBMCLOUD_API_KEY environment variable
+//  5. the BLUEMIX_API_KEY environment variable
+//  6. the password of the registry in the docker config.json
+//  7. the session of a logged in IBM Cloud CLI
+func DefaultCredentialProviders(opts SessionOptions) []CredentialProvider {
+	profile := opts.TrustedProfile
+	if profile == "" {
+		profile = os.Getenv("IBMCLOUD_TRUSTED_PROFILE_ID")
+	}
+	crTokenFile := opts.CRTokenFile
+	if crTokenFile == "" {
+		crTokenFile = envOrDefault("IBMCLOUD_CR_TOKEN_FILE", DefaultCRTokenFile)
+	}
+
+	return []CredentialProvider{
+		&apiKeyFileProvider{path: opts.APIKeyFile},
+		&trustedProfileProvider{profile: profile, tokenFile: crTokenFile},
+		&iamTokenFileProvider{path: opts.IAMTokenFile},
+		&apiKeyEnvProvider{name: "IBMCLOUD_API_KEY"},
+		&apiKeyEnvProvider{name: "BLUEMIX_API_KEY"},
+		&dockerConfigProvider{},
+		&cliConfigProvider{},
+	}
+}
+
+// retrieveCredentials from the first provider that has them
+func retrieveCredentials(providers []CredentialProvider, config *ibmcloud.Config, registry string) (CredentialProvider, string, error) {
+	for _, provider := range providers {
+		accountID, ok, err := provider.Retrieve(config, registry)
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "Unable to read credentials from %s", provider.Name())
+		}
+		if ok {
+			addSecret(config.BluemixAPIKey)
+			addSecret(config.IAMAccessToken)
+			addSecret(config.IAMRefreshToken)
+			logrus.Infof("Using IBM Cloud credentials from %s", provider.Name())
+			return provider, accountID, nil
+		}
+		logrus.Debugf("No IBM Cloud credentials in %s", provider.Name())
+	}
+	return nil, "", errors.New("No IBM Cloud credentials found, provide an API key or log in with the IBM Cloud CLI")
+}
+
+type apiKeyFileProvider struct {
+	path string
+}
+
+func (p *apiKeyFileProvider) Name() string {
+	return fmt.Sprintf("API key file %s", p.path)
+}
+
+func (p *apiKeyFileProvider) Retrieve(config *ibmcloud.Config, _ string) (string, bool, error) {
+	if p.path == "" {
+		return "", false, nil
+	}
+	data, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return "", false, err
+	}
+	apiKey := strings.TrimSpace(string(data))
+	if apiKey == "" {
+		return "", false, errors.New("API key file is empty")
+	}
+	config.BluemixAPIKey = apiKey
+	return "", true, nil
+}
+
+type apiKeyEnvProvider struct {
+	name string
+}
+
+func (p *apiKeyEnvProvider) Name() string {
+	return fmt.Sprintf("environment variable %s", p.name)
+}
+
+func (p *apiKeyEnvProvider) Retrieve(config *ibmcloud.Config, _ string) (string, bool, error) {
+	apiKey := strings.TrimSpace(os.Getenv(p.name))
+	if apiKey == "" {
+		return "", false, nil
+	}
+	config.BluemixAPIKey = apiKey
+	return "", true, nil
+}
+
+type dockerConfigProvider struct{}
+
+func (p *dockerConfigProvider) Name() string {
+	return "docker config"
+}
+
+// Retrieve never fails, a docker config without an API key for the
+// registry leaves the decision to the next provider
+func (p *dockerConfigProvider) Retrieve(config *ibmcloud.Config, registry string) (string, bool, error) {
+	accountID, err := configFromDocker(config, registry)
+	if err != nil {
+		logrus.Debugf("Error Fetching Docker Config: %v", err)
+		return "", false, nil
+	}
+	return accountID, config.BluemixAPIKey != "", nil
+}
+
+type cliConfigProvider struct{}
+
+func (p *cliConfigProvider) Name() string {
+	return "IBM Cloud CLI session"
+}
+
+func (p *cliConfigProvider) Retrieve(config *ibmcloud.Config, _ string) (string, bool, error) {
+	accountID, err := configFromJSON(config)
+	if os.IsNotExist(errors.Cause(err)) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return accountID, true, nil
+}
+
 // NewRegistryClient Authenticates with IBM Cloud using provided API Key
 // Fixes the image name if the registry name isn't part of it
-func NewRegistryClient(imageName string) (*IBMRegistrySession, string, error) {
+// All requests made by the session are bound to ctx
+func NewRegistryClient(ctx context.Context, imageName string, opts SessionOptions) (*IBMRegistrySession, string, error) {
 	var (
 		c = &ibmcloud.Config{
-			Region:        "us-south",
 			BluemixAPIKey: "",
+			HTTPTimeout:   opts.Timeout,
 		}
 
-		authSession       *session.Session
-		endpointcp        *string
-		account, endpoint string
-		iamAPI            iamv1.IAMServiceAPI
-		registryAPI       registryv1.RegistryServiceAPI
-		userInfo          *iamv1.UserInfo
-		err               error
-		url               url.URL
+		authSession                 *session.Session
+		endpointcp                  *string
+		account, endpoint, registry string
+		region, imageRegistry       string
+		iamAPI                      iamv1.IAMServiceAPI
+		userInfo                    *iamv1.UserInfo
+		provider                    CredentialProvider
+		err                         error
 	)
 
-	c.HTTPClient = NewHTTPClient(c)
-	endpointcp = getRegistryEndpoint(imageName)
-
-	if endpointcp == nil {
-		var registry string
-
-		registry, err = endpoints.NewEndpointLocator(c.Region).ContainerRegistryEndpoint()
-		if err != nil {
-			return nil, imageName, errors.Wrap(err, "Unsupported IBM Cloud default region")
-		}
-		endpoint = registry
-		imageName, err = addRegistry(registry, imageName)
-		if err != nil {
-			return nil, imageName, err
-		}
-		url, err := url.Parse(endpoint)
-		if err != nil {
-			return nil, imageName, errors.Wrap(err, "Error Parsing registry endpoint")
-		}
-		endpointcp = &url.Host
-	} else {
-		endpoint = fmt.Sprintf("https://%s", *endpointcp)
+	c.HTTPClient = NewHTTPClient(ctx, c)
+	if endpointcp = getRegistryEndpoint(imageName); endpointcp != nil {
+		imageRegistry = *endpointcp
 	}
 
-	_, err = configFromDocker(c, *endpointcp)
+	registry, region, err = resolveRegistry(imageRegistry, opts)
 	if err != nil {
-		logrus.Errorf("Error Fetching Docker Config: ", err)
+		return nil, imageName, newBuildError(ErrUsage, err)
 	}
-	if c.BluemixAPIKey == "" {
-		logrus.Warnf("Bluemix not set, trying to use a pre-authenticated CLI Session...")
-		account, err = configFromJSON(c)
-		if err != nil {
-			return nil, imageName, errors.Wrap(err, "IBM Cloud configuration error.")
-		}
+	logrus.Debugf("Using registry %s in region %s", registry, region)
+	c.Region = iamRegion(region)
+	endpoint = registryScheme + registry
+	endpointcp = &registry
+	imageName, err = addRegistry(endpoint, imageName)
+	if err != nil {
+		return nil, imageName, err
+	}
+
+	providers := opts.CredentialProviders
+	if providers == nil {
+		providers = DefaultCredentialProviders(opts)
+	}
+	retry := opts.Retry
+	if retry.MaxAttempts == 0 {
+		retry = DefaultRetryPolicy
+	}
+	err = retry.Do(ctx, "Retrieving IBM Cloud credentials", func() (err error) {
+		provider, account, err = retrieveCredentials(providers, c, *endpointcp)
+		return err
+	})
+	if err != nil {
+		return nil, imageName, errors.Wrap(err, "IBM Cloud configuration error.")
 	}
 	authSession, err = session.New(c)
 	if err != nil {
 		return nil, imageName, errors.Wrap(err, "IBM Cloud configuration error.")
 	}
-	iamAPI, err = iamv1.New(authSession)
+	err = retry.Do(ctx, "Retrieving IBM Cloud IAM tokens", func() (err error) {
+		iamAPI, err = iamv1.New(authSession)
+		return err
+	})
 	if err != nil {
 		return nil, imageName, errors.Wrap(err, "IBM Cloud auth error.")
 	}
 
 	if account == "" {
-		userInfo, err = iamAPI.Identity().UserInfo()
+		err = retry.Do(ctx, "Fetching IBM Cloud user info", func() (err error) {
+			userInfo, err = iamAPI.Identity().UserInfo()
+			return err
+		})
 		if err != nil {
 			return nil, imageName, errors.Wrap(err, "IBM Cloud fetching user account error.")
 		}
@@ -169,17 +377,157 @@ func NewRegistryClient(imageName string) (*IBMRegistrySession, string, error) {
 	}
 
 	c.Endpoint = &endpoint
-	registryAPI, err = registryv1.New(authSession)
+	registrySession := &IBMRegistrySession{
+		Registry: *endpointcp,
+		BuildTargetHeader: registryv1.BuildTargetHeader{
+			AccountID: account,
+		},
+		ctx:    ctx,
+		retry:  retry,
+		config: c,
+	}
+	registrySession.renew = renewIAMToken
+	if renewer, ok := provider.(tokenRenewer); ok {
+		registrySession.renew = renewer.RenewToken
+	}
+	err = retry.Do(ctx, "Authenticating with IBM Cloud", func() error {
+		return registrySession.connect(authSession)
+	})
 	if err != nil {
 		return nil, imageName, errors.Wrap(err, "IBM Cloud auth error.")
 	}
 
-	return &IBMRegistrySession{
-		BuildTargetHeader: registryv1.BuildTargetHeader{
-			AccountID: account,
+	return registrySession, imageName, nil
+}
+
+// connect creates the registry APIs, they copy the IAM token of the session
+func (s *IBMRegistrySession) connect(authSession *session.Session) error {
+	err := authSession.Config.ValidateConfigForService(ibmcloud.ContainerRegistryService)
+	if err != nil {
+		return err
+	}
+	if authSession.Config.IAMAccessToken == "" {
+		if err := populateIAMTokens(authSession.Config); err != nil {
+			return err
+		}
+	}
+	extraAPI, err := newRegistryAPI(authSession, s)
+	if err != nil {
+		return err
+	}
+	registryAPI, err := registryv1.New(authSession)
+	if err != nil {
+		return err
+	}
+	buildAPI, err := newBuildAPI(authSession)
+	if err != nil {
+		return err
+	}
+
+	s.apis = RegistryAPIs{
+		Builds:      buildAPI,
+		Images:      registryAPI.Images(),
+		Namespaces:  registryAPI.Namespaces(),
+		RegistryAPI: extraAPI,
+	}
+	s.expiry = tokenExpiry(s.config.IAMAccessToken)
+	addSecret(s.config.IAMAccessToken)
+	addSecret(s.config.IAMRefreshToken)
+	return nil
+}
+
+// Refresh renews the IAM token of the session when it is about to expire and
+// returns the registry APIs created with the current token. It should be
+// called before each use of the APIs since a long build can outlive the
+// token, concurrent builds may share the session.
+func (s *IBMRegistrySession) Refresh() (RegistryAPIs, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.expiry.IsZero() || time.Until(s.expiry) > tokenRefreshMargin {
+		return s.apis, nil
+	}
+	logrus.Debugf("IAM token expires at %v, renewing", s.expiry)
+	if err := s.reauthenticate(); err != nil {
+		return RegistryAPIs{}, err
+	}
+	return s.apis, nil
+}
+
+// Reauthenticate renews the IAM token regardless of its expiry, for when
+// the registry rejected it
+func (s *IBMRegistrySession) Reauthenticate() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.reauthenticate()
+}
+
+// iamBearerUser is the registry user that logs in with an IAM access token
+const iamBearerUser = "iambearer"
+
+// RegistryCredentials to log in to the registry with, for a docker or
+// BuildKit daemon that pushes the image
+func (s *IBMRegistrySession) RegistryCredentials() (string, string, error) {
+	if _, err := s.Refresh(); err != nil {
+		return "", "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return iamBearerUser, strings.TrimPrefix(s.config.IAMAccessToken, bearerPrefix), nil
+}
+
+func (s *IBMRegistrySession) reauthenticate() error {
+	if s.renew == nil {
+		return errors.New("IAM token can not be renewed")
+	}
+	err := s.retry.Do(s.ctx, "Renewing IAM token", func() error {
+		return s.renew(s.config)
+	})
+	if err != nil {
+		return errors.Wrap(err, "Unable to renew IAM token")
+	}
+	authSession, err := session.New(s.config)
+	if err != nil {
+		return err
+	}
+	return s.connect(authSession)
+}
+
+// populateIAMTokens exchanges the credentials of config for IAM tokens
+func populateIAMTokens(config *ibmcloud.Config) error {
+	tokenRefresher, err := authentication.NewIAMAuthRepository(config, &rest.Client{
+		DefaultHeader: http.Header{
+			"User-Agent": []string{bmxhttp.UserAgent()},
+		},
+		HTTPClient: config.HTTPClient,
+	})
+	if err != nil {
+		return err
+	}
+	return authentication.PopulateTokens(tokenRefresher, config)
+}
+
+// renewIAMToken with the refresh token of a CLI session, or by exchanging
+// the API key again
+func renewIAMToken(config *ibmcloud.Config) error {
+	tokenRefresher, err := authentication.NewIAMAuthRepository(config, &rest.Client{
+		DefaultHeader: http.Header{
+			"User-Agent": []string{bmxhttp.UserAgent()},
 		},
-		Builds: registryAPI.Builds(),
-	}, imageName, nil
+		HTTPClient: config.HTTPClient,
+	})
+	if err != nil {
+		return err
+	}
+	if config.IAMRefreshToken != "" {
+		_, err = tokenRefresher.RefreshToken()
+		return err
+	}
+	if config.BluemixAPIKey != "" && config.BluemixAPIKey != na {
+		return tokenRefresher.AuthenticateAPIKey(config.BluemixAPIKey)
+	}
+	return errors.New("No refresh token or API key to renew the IAM token with")
 }
 
 func getRegistryEndpoint(imageName string) *string {
@@ -244,7 +592,6 @@ func configFromJSON(icconfig *ibmcloud.Config) (accountID string, err error) {
 		if err == nil {
 			err = json.Unmarshal(byteValue, config)
 			if err == nil {
-				icconfig.Region = config.Region
 				icconfig.IAMAccessToken = config.IAMToken
 				icconfig.IAMRefreshToken = config.IAMRefreshToken
 				icconfig.SSLDisable = config.SSLDisabled
@@ -258,49 +605,123 @@ func configFromJSON(icconfig *ibmcloud.Config) (accountID string, err error) {
 	return accountID, err
 }
 
-// If the authenticated with hav
+// If the authenticated with docker login or knative credentials
+// Only API keys stored as passwords are supported
 func configFromDocker(icconfig *ibmcloud.Config, endpoint string) (accountID string, err error) {
 	var (
-		config             *dockerConfig
-		jsonFile           *os.File
-		byteValue, decoded []byte
-		authToken          []string
+		config *dockerConfig
+		apiKey string
 	)
 
-	config = new(dockerConfig)
+	config, err = loadDockerConfig()
+	if err == nil {
+		apiKey, err = config.apiKey(endpoint)
+	}
+	if err != nil {
+		// The legacy file may hold the registry when config.json does not
+		legacy, legacyErr := loadLegacyDockerConfig()
+		if os.IsNotExist(legacyErr) {
+			return "", err
+		}
+		if legacyErr == nil {
+			apiKey, legacyErr = legacy.apiKey(endpoint)
+		}
+		if legacyErr != nil {
+			return "", legacyErr
+		}
+	}
+	icconfig.BluemixAPIKey = apiKey
+	return "", nil
+}
+
+// dockerConfigDir honors DOCKER_CONFIG the same way the docker CLI does
+func dockerConfigDir() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.Getenv("HOME"), ".docker")
+}
 
-	jsonFile, err = os.Open(os.Getenv("HOME") + "/.docker/config.json")
-	defer func() {
-		cerr := jsonFile.Close()
-		if err == nil {
-			err = cerr
+// loadDockerConfig reads config.json
+func loadDockerConfig() (*dockerConfig, error) {
+	config := new(dockerConfig)
+
+	byteValue, err := ioutil.ReadFile(filepath.Join(dockerConfigDir(), "config.json"))
+	if err != nil {
+		return nil, err
+	}
+	return config, json.Unmarshal(byteValue, config)
+}
+
+// loadLegacyDockerConfig reads the legacy .dockercfg format that only holds
+// the auths entries
+func loadLegacyDockerConfig() (*dockerConfig, error) {
+	config := new(dockerConfig)
+
+	byteValue, err := ioutil.ReadFile(filepath.Join(os.Getenv("HOME"), ".dockercfg"))
+	if err != nil {
+		return nil, err
+	}
+	return config, json.Unmarshal(byteValue, &config.Entries)
+}
+
+// apiKey for the registry, looked up in the same order as the docker CLI:
+// the registry credential helper, the credentials store, the inline auths
+func (c *dockerConfig) apiKey(registry string) (string, error) {
+	if helper, ok := c.CredHelpers[registry]; ok {
+		return apiKeyFromHelper(helper, registry)
+	}
+	if c.CredsStore != "" {
+		apiKey, err := apiKeyFromHelper(c.CredsStore, registry)
+		if err == nil || !credentials.IsErrCredentialsNotFound(errors.Cause(err)) {
+			return apiKey, err
 		}
-	}()
-	if err == nil {
-		byteValue, err = ioutil.ReadAll(jsonFile)
-		if err == nil {
-			err = json.Unmarshal(byteValue, config)
-			if err == nil {
-				if entry, ok := config.Entries[endpoint]; ok {
-					//Only API keys stored as passwords are supported
-					if entry.Password != "" {
-						icconfig.BluemixAPIKey = entry.Password
-					} else if entry.Auth != "" {
-						decoded, err = base64.StdEncoding.DecodeString(entry.Auth)
-						if err == nil {
-							authToken = strings.Split(string(decoded), ":")
-							if len(authToken) > 1 {
-								icconfig.BluemixAPIKey = authToken[1]
-							}
-						}
-					} else {
-						err = errors.Errorf("Found docker config but unable to find API Key!", endpoint)
-					}
-				} else {
-					err = errors.Errorf("Registry %s not found in docker creds!", endpoint)
-				}
-			}
+	}
+
+	entry, ok := c.entry(registry)
+	if !ok {
+		return "", errors.Errorf("Registry %s not found in docker creds!", registry)
+	}
+	if entry.Password != "" {
+		return entry.Password, nil
+	}
+	if entry.Auth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil {
+			return "", errors.Wrapf(err, "Invalid docker auth for %s", registry)
+		}
+		if authToken := strings.SplitN(string(decoded), ":", 2); len(authToken) > 1 && authToken[1] != "" {
+			return authToken[1], nil
 		}
 	}
-	return "", err
+	return "", errors.Errorf("Found docker config for %s but unable to find API Key!", registry)
+}
+
+// entry for the registry, the auths keys may be URLs rather than host names
+func (c *dockerConfig) entry(registry string) (entry, bool) {
+	if entry, ok := c.Entries[registry]; ok {
+		return entry, true
+	}
+	for key, entry := range c.Entries {
+		host := strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+		if i := strings.Index(host, "/"); i >= 0 {
+			host = host[:i]
+		}
+		if host == registry {
+			return entry, true
+		}
+	}
+	return entry{}, false
+}
+
+// apiKeyFromHelper runs docker-credential-<helper> to get the registry password
+func apiKeyFromHelper(helper string, registry string) (string, error) {
+	creds, err := client.Get(client.NewShellProgramFunc("docker-credential-"+helper), registry)
+	if err != nil {
+		return "", errors.Wrapf(err, "Credential helper %s failed for %s", helper, registry)
+	}
+	if creds.Secret == "" {
+		return "", errors.Errorf("Credential helper %s has no API Key for %s", helper, registry)
+	}
+	return creds.Secret, nil
 }
@@ -18,13 +18,15 @@
 package icrbuild
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"strconv"
+	"syscall"
+	"time"
 
-	"github.com/docker/cli/cli/command"
-	"github.com/docker/cli/cli/command/image"
 	"github.com/docker/distribution/reference"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -33,12 +35,43 @@ import (
 
 // BuildFlags are the flags for the docker build
 type BuildFlags struct {
-	NoCache   bool
-	Pull      bool
-	Quiet     bool
-	BuildArgs []string
-	File      string
-	Tag       string
+	NoCache    bool
+	Pull       bool
+	Quiet      bool
+	Squash     bool
+	BuildArgs  []string
+	File       string
+	Tags       []string
+	Timeout    time.Duration
+	DigestFile string
+	ResultsDir string
+	VAPolicy   string
+	VATimeout  time.Duration
+	VAAction   string
+	Region     string
+	Registry   string
+	APIKeyFile string
+
+	TrustedProfile string
+	CRTokenFile    string
+	IAMTokenFile   string
+
+	MaxAttempts        int
+	CreateNamespace    bool
+	QuotaWarnThreshold float64
+
+	Retain        int
+	RetainWithin  string
+	RetainProtect string
+	RetainDryRun  bool
+
+	DryRun bool
+	Output string
+
+	MaxContextSize string
+
+	Backend         string
+	BuildKitAddress string
 }
 
 // BuildOptions hold the io streams for the build
@@ -48,6 +81,14 @@ type BuildOptions struct {
 	Err io.Writer
 
 	Flags BuildFlags
+
+	// ContextFetchers stage contexts that are not a local directory,
+	// DefaultContextFetchers when nil
+	ContextFetchers []ContextFetcher
+
+	events *eventLog
+	start  time.Time
+	log    *logrus.Entry
 }
 
 // BuildRunner holds the the method that runs the build
@@ -61,54 +102,273 @@ func NewBuildOptions(in io.Reader, out io.Writer, err io.Writer) *BuildOptions {
 		In:  in,
 		Out: out,
 		Err: err,
+		log: logrus.NewEntry(logrus.StandardLogger()),
 	}
 }
 
 // Run the method that runs the build
 func (o *BuildOptions) Run(cmd *cobra.Command, args []string) error {
+	if o.Flags.Output == OutputJSON && !o.Flags.DryRun {
+		o.events = newEventLog(o.Out)
+	}
+
+	o.start = time.Now()
+	imageName, digest, err := o.run(args)
+	if err != nil {
+		o.events.errorEvent(err)
+		return err
+	}
+	o.events.emit(Event{Type: EventResult, Image: imageName, Digest: digest, Duration: time.Since(o.start).Seconds()})
+	return nil
+}
+
+// run the build and return the name and digest of the image
+func (o *BuildOptions) run(args []string) (string, string, error) {
+	contextPath, err := buildContextPath(args)
+	if err != nil {
+		return "", "", newBuildError(ErrUsage, err)
+	}
+	o.applyTektonDefaults()
+
+	if err = o.validate(); err != nil {
+		return "", "", err
+	}
+
+	ctx, cancel := newBuildContext(o.Flags.Timeout, o.log)
+	defer cancel()
+
+	contextPath, cleanup, err := o.stageContext(ctx, contextPath)
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", "", newBuildError(ErrCancelled, cancelledError(ctx))
+		}
+		return "", "", newBuildError(ErrContext, err)
+	}
+	defer cleanup()
+
+	if o.Flags.DryRun {
+		return "", "", o.dryRun(contextPath)
+	}
+
+	if err = o.checkContextSize(contextPath); err != nil {
+		return "", "", err
+	}
+
+	finish := o.events.phase(PhaseAuthenticate)
+	registryClient, imageName, err := NewRegistryClient(ctx, o.Flags.Tags[0], o.sessionOptions())
+	if err != nil {
+		if ctx.Err() != nil {
+			err = newBuildError(ErrCancelled, cancelledError(ctx))
+		} else {
+			err = withClass(ErrAuth, errors.Wrap(err, "Unable to Connect to IBM Cloud"))
+		}
+	}
+	finish(err)
+	if err != nil {
+		return imageName, "", err
+	}
+
+	digest, err := o.build(ctx, registryClient, imageName, contextPath)
+	return imageName, digest, err
+}
+
+// validate checks the build flags
+func (o *BuildOptions) validate() error {
+	if len(o.Flags.Tags) == 0 {
+		return newBuildError(ErrUsage, errors.Errorf("At least one image tag is required!"))
+	}
+	for _, tag := range o.Flags.Tags {
+		if !reference.ReferenceRegexp.MatchString(tag) {
+			return newBuildError(ErrUsage, errors.Errorf("Image Name %s is not correct format!", tag))
+		}
+	}
+
+	if err := o.validateVAFlags(); err != nil {
+		return newBuildError(ErrUsage, err)
+	}
+	if err := o.validateRetentionFlags(); err != nil {
+		return newBuildError(ErrUsage, err)
+	}
+	if o.Flags.QuotaWarnThreshold < 0 || o.Flags.QuotaWarnThreshold > 100 {
+		return newBuildError(ErrUsage, errors.Errorf("Quota warn threshold %v is not a percentage", o.Flags.QuotaWarnThreshold))
+	}
+
+	if err := o.validateOutput(); err != nil {
+		return newBuildError(ErrUsage, err)
+	}
+	if err := o.validateBackend(); err != nil {
+		return newBuildError(ErrUsage, err)
+	}
+	return nil
+}
 
+// build the local context directory with an authenticated session and
+// return the digest of the image
+func (o *BuildOptions) build(ctx context.Context, registryClient *IBMRegistrySession, imageName string, contextPath string) (string, error) {
 	var (
-		registryClient          *IBMRegistrySession
-		imageName, buildContext string
-		err                     error
-		cli                     *builderCLI
-		ccmd                    *cobra.Command
+		buildContext string
+		digest       string
+		err          error
 	)
 
-	if !reference.ReferenceRegexp.MatchString(o.Flags.Tag) {
-		return errors.Errorf("Image Name is not correct format!")
+	imageNames := []string{imageName}
+	for _, tag := range o.Flags.Tags[1:] {
+		tag, err = registryClient.ImageName(tag)
+		if err != nil {
+			return "", newBuildError(ErrUsage, err)
+		}
+		imageNames = append(imageNames, tag)
 	}
 
-	registryClient, imageName, err = NewRegistryClient(o.Flags.Tag)
+	finish := o.events.phase(PhasePreflight)
+	err = o.ensureNamespaces(registryClient, imageNames)
+	if err == nil {
+		err = o.checkQuota(registryClient)
+	}
+	finish(err)
 	if err != nil {
-		return errors.Wrap(err, "Unable to Connect to IBM Cloud")
+		return "", err
 	}
 
-	logrus.Debugf("Running IBM Container Registry build: context: %s, dockerfile: %s", args[0], o.Flags.File)
+	o.log.Debugf("Running IBM Container Registry build: context: %s, dockerfile: %s", contextPath, o.Flags.File)
 
-	buildContext, err = filepath.Abs(args[0])
+	buildContext, err = filepath.Abs(contextPath)
 	if err != nil {
-		logrus.Errorf("Error parsing build context: %v", err)
-		return errors.Wrap(err, "Docker build Context error! Check supplied context path")
+		o.log.Errorf("Error parsing build context: %v", err)
+		return "", newBuildError(ErrContext, errors.Wrap(err, "Docker build Context error! Check supplied context path"))
 	}
 
-	cli = &builderCLI{*command.NewDockerCli(os.Stdin, os.Stdout, os.Stderr, false), NewBuilder(registryClient)}
+	backend := o.newBackend(registryClient)
+	finish = o.events.phase(PhaseBuild)
+	digest, err = backend.Build(ctx, imageName, buildContext)
+	err = classifyBuildError(err)
+	finish(err)
+	if err != nil {
+		return "", err
+	}
+
+	finish = o.events.phase(PhaseTag)
+	err = o.tagImages(registryClient, imageNames)
+	finish(err)
+	if err != nil {
+		return "", err
+	}
+
+	if o.Flags.VAPolicy != "" {
+		finish = o.events.phase(PhaseScan)
+		err = o.checkVulnerabilities(ctx, registryClient, imageNames)
+		finish(err)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	finish = o.events.phase(PhaseResults)
+	digest, err = o.builtDigest(registryClient, imageName, digest)
+	if err == nil {
+		err = o.writeResults(imageName, digest)
+	}
+	finish(err)
+	if err != nil {
+		return digest, err
+	}
 
-	ccmd = image.NewBuildCommand(cli)
+	if o.Flags.Retain > 0 || o.Flags.RetainWithin != "" {
+		finish = o.events.phase(PhaseCleanup)
+		err = o.applyRetention(registryClient, imageName, digest)
+		finish(err)
+	}
+	return digest, err
+}
+
+// tagImages applies the additional tags in the registry, the build service
+// only pushes the first one, and reports the digest each tag resolved to
+func (o *BuildOptions) tagImages(registryClient *IBMRegistrySession, imageNames []string) error {
+	for _, imageName := range imageNames[1:] {
+		o.log.Debugf("Tagging %s as %s", imageNames[0], imageName)
+		apis, err := registryClient.Refresh()
+		if err != nil {
+			return newBuildError(ErrAuth, err)
+		}
+		err = apis.RegistryAPI.TagImage(imageNames[0], imageName, registryClient.ImageTargetHeader())
+		if err != nil {
+			return newBuildError(ErrBuild, errors.Wrapf(err, "Unable to tag %s as %s", imageNames[0], imageName))
+		}
+	}
+
+	if len(imageNames) == 1 {
+		return nil
+	}
+
+	var built string
+	for _, imageName := range imageNames {
+		digest, err := registryClient.ResolveDigest(imageName)
+		if err != nil {
+			o.log.Warnf("Unable to resolve digest: %v", err)
+			continue
+		}
+		if built == "" {
+			built = digest
+		} else if digest != built {
+			o.log.Warnf("Tag %s resolved to %s but the build produced %s", imageName, digest, built)
+		}
+		if o.events.enabled() {
+			o.events.emit(Event{Type: EventTag, Phase: PhaseTag, Image: imageName, Digest: digest})
+			continue
+		}
+		fmt.Fprintf(o.Out, "%s@%s\n", imageName, digest)
+	}
+	return nil
+}
+
+// sessionOptions from the flags
+func (o *BuildOptions) sessionOptions() SessionOptions {
+	return SessionOptions{
+		Timeout:        o.Flags.Timeout,
+		Region:         o.Flags.Region,
+		Registry:       o.Flags.Registry,
+		APIKeyFile:     o.Flags.APIKeyFile,
+		TrustedProfile: o.Flags.TrustedProfile,
+		CRTokenFile:    o.Flags.CRTokenFile,
+		IAMTokenFile:   o.Flags.IAMTokenFile,
+		Retry:          o.retryPolicy(),
+	}
+}
+
+// retryPolicy with the attempts from the flags, at least one
+func (o *BuildOptions) retryPolicy() RetryPolicy {
+	policy := DefaultRetryPolicy
+	policy.MaxAttempts = o.Flags.MaxAttempts
+	if policy.MaxAttempts < 1 {
+		policy.MaxAttempts = 1
+	}
+	return policy
+}
+
+// newBuildContext is cancelled on SIGINT, SIGTERM or once timeout elapses
+func newBuildContext(timeout time.Duration, log *logrus.Entry) (context.Context, context.CancelFunc) {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
 
-	ccmd.Flags().Set("tag", imageName)
-	ccmd.Flags().Set("no-cache", strconv.FormatBool(o.Flags.NoCache))
-	ccmd.Flags().Set("quiet", strconv.FormatBool(o.Flags.Quiet))
-	ccmd.Flags().Set("pull", strconv.FormatBool(o.Flags.Pull))
-	ccmd.Flags().Set("disable-content-trust", "true")
-	ccmd.Flags().Set("file", o.Flags.File)
-	for _, buildFlag := range o.Flags.BuildArgs {
-		ccmd.Flags().Set("build-arg", buildFlag)
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
 	}
 
-	// Woraround a defect whem term is set
-	os.Unsetenv("TERM")
-	err = ccmd.RunE(nil, []string{buildContext})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		defer signal.Stop(signals)
+		select {
+		case sig := <-signals:
+			log.Warnf("Received %v, cancelling build", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
 
-	return err
+	return ctx, cancel
 }
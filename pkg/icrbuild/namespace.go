@@ -0,0 +1,89 @@
+// ------------------------------------------------------------------------------
+// Copyright IBM Corp. 2018
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ------------------------------------------------------------------------------
+
+// Package icrbuild ...
+package icrbuild
+
+import (
+	"strings"
+
+	"github.com/IBM-Cloud/bluemix-go/api/container/registryv1"
+	"github.com/docker/distribution/reference"
+	"github.com/pkg/errors"
+)
+
+// imageNamespace is the registry namespace of the image, the first path component
+func imageNamespace(imageName string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(imageName)
+	if err != nil {
+		return "", errors.Wrapf(err, "Unable to parse image name %s", imageName)
+	}
+	return strings.SplitN(reference.Path(named), "/", 2)[0], nil
+}
+
+// NamespaceTargetHeader for the account of the session
+func (s *IBMRegistrySession) NamespaceTargetHeader() registryv1.NamespaceTargetHeader {
+	return registryv1.NamespaceTargetHeader{
+		AccountID: s.BuildTargetHeader.AccountID,
+	}
+}
+
+// ensureNamespaces checks that the namespaces of the images belong to the
+// account before the context is uploaded, creating them if asked to
+func (o *BuildOptions) ensureNamespaces(registryClient *IBMRegistrySession, imageNames []string) error {
+	var existing []string
+
+	apis, err := registryClient.Refresh()
+	if err != nil {
+		return newBuildError(ErrAuth, err)
+	}
+	err = registryClient.retry.withLog(o.log).Do(registryClient.ctx, "Listing namespaces", func() (err error) {
+		existing, err = apis.Namespaces.GetNamespaces(registryClient.NamespaceTargetHeader())
+		return err
+	})
+	if err != nil {
+		return withClass(ErrNamespace, errors.Wrap(err, "Unable to list namespaces"))
+	}
+
+	found := make(map[string]bool, len(existing))
+	for _, namespace := range existing {
+		found[namespace] = true
+	}
+
+	for _, imageName := range imageNames {
+		namespace, err := imageNamespace(imageName)
+		if err != nil {
+			return newBuildError(ErrUsage, err)
+		}
+		if found[namespace] {
+			continue
+		}
+		if !o.Flags.CreateNamespace {
+			return newBuildError(ErrNamespace, errors.Errorf("Namespace %s does not exist in registry %s for account %s, create it or use --create-namespace", namespace, registryClient.Registry, registryClient.BuildTargetHeader.AccountID))
+		}
+
+		o.log.Infof("Creating namespace %s in registry %s", namespace, registryClient.Registry)
+		err = registryClient.retry.withLog(o.log).Do(registryClient.ctx, "Creating namespace", func() error {
+			_, err := apis.Namespaces.AddNamespace(namespace, registryClient.NamespaceTargetHeader())
+			return err
+		})
+		if err != nil {
+			return withClass(ErrNamespace, errors.Wrapf(err, "Unable to create namespace %s", namespace))
+		}
+		found[namespace] = true
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+// ------------------------------------------------------------------------------
+// Copyright IBM Corp. 2018
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ------------------------------------------------------------------------------
+
+// Package icrbuild ...
+package icrbuild
+
+import (
+	"github.com/docker/go-units"
+	"github.com/pkg/errors"
+)
+
+// DefaultQuotaWarnThreshold is the percentage of a quota at which to warn
+const DefaultQuotaWarnThreshold = 90
+
+// checkQuota fails before the context is uploaded when the account is over
+// its storage or pull traffic quota and warns when it is close to one.
+// Failing to query the quota is not fatal, the build reports it if it matters.
+func (o *BuildOptions) checkQuota(registryClient *IBMRegistrySession) error {
+	var (
+		quota *Quota
+		plan  *Plan
+	)
+
+	apis, err := registryClient.Refresh()
+	if err != nil {
+		return newBuildError(ErrAuth, err)
+	}
+	err = registryClient.retry.withLog(o.log).Do(registryClient.ctx, "Fetching quota", func() (err error) {
+		quota, err = apis.RegistryAPI.GetQuota(registryClient.ImageTargetHeader())
+		return err
+	})
+	if err != nil {
+		o.log.Warnf("Unable to check the registry quota: %v", err)
+		return nil
+	}
+	err = registryClient.retry.withLog(o.log).Do(registryClient.ctx, "Fetching plan", func() (err error) {
+		plan, err = apis.RegistryAPI.GetPlan(registryClient.ImageTargetHeader())
+		return err
+	})
+	if err != nil {
+		o.log.Debugf("Unable to fetch the registry plan: %v", err)
+		plan = &Plan{Plan: "unknown"}
+	}
+
+	for _, check := range []struct {
+		name         string
+		usage, limit int64
+	}{
+		{"storage", quota.Usage.StorageBytes, quota.Limit.StorageBytes},
+		{"pull traffic", quota.Usage.TrafficBytes, quota.Limit.TrafficBytes},
+	} {
+		// A limit of zero or less means there is no quota, nothing to check
+		if check.limit <= 0 {
+			continue
+		}
+		used := units.BytesSize(float64(check.usage))
+		limit := units.BytesSize(float64(check.limit))
+		if check.usage >= check.limit {
+			return newBuildError(ErrQuota, errors.Errorf("The %s quota of account %s is exceeded: %s used of %s on the %s plan. Free up space, raise the quota or upgrade the plan", check.name, registryClient.BuildTargetHeader.AccountID, used, limit, plan.Plan))
+		}
+		if float64(check.usage) >= float64(check.limit)*o.Flags.QuotaWarnThreshold/100 {
+			o.log.Warnf("The %s quota of account %s is nearly used up: %s used of %s on the %s plan", check.name, registryClient.BuildTargetHeader.AccountID, used, limit, plan.Plan)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+// ------------------------------------------------------------------------------
+// Copyright IBM Corp. 2018
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ------------------------------------------------------------------------------
+
+// Package icrbuild ...
+package icrbuild
+
+import (
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultRegion  = "us-south"
+	globalRegion   = "global"
+	privatePrefix  = "private."
+	regionEnvVar   = "IBMCLOUD_REGION"
+	registryScheme = "https://"
+)
+
+// registryRegions maps the registry host names to the region they serve
+var registryRegions = map[string]string{
+	"icr.io":     globalRegion,
+	"us.icr.io":  "us-south",
+	"uk.icr.io":  "eu-gb",
+	"de.icr.io":  "eu-de",
+	"au.icr.io":  "au-syd",
+	"jp.icr.io":  "jp-tok",
+	"jp2.icr.io": "jp-osa",
+	"ca.icr.io":  "ca-tor",
+	"br.icr.io":  "br-sao",
+
+	"registry.bluemix.net":        globalRegion,
+	"registry.ng.bluemix.net":     "us-south",
+	"registry.eu-gb.bluemix.net":  "eu-gb",
+	"registry.eu-de.bluemix.net":  "eu-de",
+	"registry.au-syd.bluemix.net": "au-syd",
+}
+
+// regionRegistries maps a region to the registry used when the image has none
+var regionRegistries = map[string]string{
+	globalRegion: "icr.io",
+	"us-south":   "us.icr.io",
+	"us-east":    "us.icr.io",
+	"eu-gb":      "uk.icr.io",
+	"eu-de":      "de.icr.io",
+	"au-syd":     "au.icr.io",
+	"jp-tok":     "jp.icr.io",
+	"jp-osa":     "jp2.icr.io",
+	"ca-tor":     "ca.icr.io",
+	"br-sao":     "br.icr.io",
+}
+
+// iamRegions are the regions bluemix-go can locate the IAM endpoint for,
+// IAM is global so any of them will do for the others
+var iamRegions = map[string]bool{
+	"us-south": true,
+	"us-east":  true,
+	"eu-gb":    true,
+	"au-syd":   true,
+	"eu-de":    true,
+	"jp-tok":   true,
+}
+
+// RegistryRegion returns the region served by a registry host, private
+// endpoints serve the same region as their public counterpart
+func RegistryRegion(registry string) (string, bool) {
+	region, ok := registryRegions[strings.TrimPrefix(registry, privatePrefix)]
+	return region, ok
+}
+
+// resolveRegistry selects the registry host and the region to build in.
+// A registry in the image name wins over --registry, which wins over the
+// default registry of the region selected by --region or IBMCLOUD_REGION.
+// Explicit settings that disagree with each other are rejected.
+func resolveRegistry(imageRegistry string, opts SessionOptions) (string, string, error) {
+	region := opts.Region
+	if region == "" {
+		region = os.Getenv(regionEnvVar)
+	}
+	registry := strings.TrimSuffix(strings.TrimPrefix(opts.Registry, registryScheme), "/")
+
+	if imageRegistry != "" {
+		if registry != "" && registry != imageRegistry {
+			return "", "", errors.Errorf("Image registry %s does not match --registry %s", imageRegistry, registry)
+		}
+		registry = imageRegistry
+	}
+
+	if registry == "" {
+		selected := region
+		if selected == "" {
+			selected = defaultRegion
+		}
+		var ok bool
+		registry, ok = regionRegistries[selected]
+		if !ok {
+			return "", "", errors.Errorf("No IBM Cloud Container Registry known for region %s, use --registry", selected)
+		}
+		return registry, selected, nil
+	}
+
+	registryRegion, known := RegistryRegion(registry)
+	switch {
+	case !known:
+		logrus.Warnf("Registry %s is not a known IBM Cloud Container Registry, unable to validate its region", registry)
+		if region == "" {
+			region = defaultRegion
+		}
+	case region == "":
+		region = registryRegion
+	case registryRegion == globalRegion:
+		// The global registry serves every region
+	case !registryServesRegion(registryRegion, region):
+		return "", "", errors.Errorf("Registry %s serves region %s but region %s was selected", registry, registryRegion, region)
+	}
+	return registry, region, nil
+}
+
+// registryServesRegion reports whether the registry of registryRegion is also
+// the registry of region, us.icr.io serves us-east as well as us-south
+func registryServesRegion(registryRegion string, region string) bool {
+	return registryRegion == region || regionRegistries[region] == regionRegistries[registryRegion]
+}
+
+// iamRegion is the region handed to bluemix-go for locating IAM
+func iamRegion(region string) string {
+	if iamRegions[region] {
+		return region
+	}
+	return defaultRegion
+}
@@ -0,0 +1,286 @@
+// ------------------------------------------------------------------------------
+// Copyright IBM Corp. 2018
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ------------------------------------------------------------------------------
+
+// Package icrbuild ...
+package icrbuild
+
+import (
+	"fmt"
+	"io"
+	gohttp "net/http"
+	"strconv"
+	"strings"
+
+	ibmcloud "github.com/IBM-Cloud/bluemix-go"
+	"github.com/IBM-Cloud/bluemix-go/api/container/registryv1"
+	"github.com/IBM-Cloud/bluemix-go/authentication"
+	"github.com/IBM-Cloud/bluemix-go/client"
+	"github.com/IBM-Cloud/bluemix-go/helpers"
+	"github.com/IBM-Cloud/bluemix-go/http"
+	"github.com/IBM-Cloud/bluemix-go/rest"
+	"github.com/IBM-Cloud/bluemix-go/session"
+	"github.com/docker/distribution/reference"
+	"github.com/pkg/errors"
+)
+
+// RegistryAPI Container Registry APIs not provided by bluemix-go registryv1
+type RegistryAPI interface {
+	TagImage(fromImage string, toImage string, target registryv1.ImageTargetHeader) error
+	UntagImage(imageName string, target registryv1.ImageTargetHeader) error
+	GetQuota(target registryv1.ImageTargetHeader) (*Quota, error)
+	GetPlan(target registryv1.ImageTargetHeader) (*Plan, error)
+}
+
+// QuotaValues in bytes, zero or negative limits mean unlimited or not reported
+type QuotaValues struct {
+	StorageBytes int64 `json:"storage_bytes"`
+	TrafficBytes int64 `json:"traffic_bytes"`
+}
+
+// Quota of the account and its current usage
+type Quota struct {
+	Limit QuotaValues `json:"limit"`
+	Usage QuotaValues `json:"usage"`
+}
+
+// Plan of the account
+type Plan struct {
+	Plan string `json:"plan"`
+}
+
+type registry struct {
+	client *client.Client
+}
+
+// newRegistryAPI is built the same way as registryv1.New, with a copy of the
+// session config. The token is renewed through the registry session so that
+// the session and its other APIs get the new token too.
+func newRegistryAPI(sess *session.Session, registrySession *IBMRegistrySession) (RegistryAPI, error) {
+	config := sess.Config.Copy()
+	err := config.ValidateConfigForService(ibmcloud.ContainerRegistryService)
+	if err != nil {
+		return nil, err
+	}
+	tokenRefresher, err := authentication.NewIAMAuthRepository(config, &rest.Client{
+		DefaultHeader: gohttp.Header{
+			"User-Agent": []string{http.UserAgent()},
+		},
+		HTTPClient: config.HTTPClient,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &registry{
+		client: client.New(config, ibmcloud.ContainerRegistryService, &sessionTokenRefresher{
+			TokenProvider: tokenRefresher,
+			session:       registrySession,
+			config:        config,
+		}),
+	}, nil
+}
+
+// sessionTokenRefresher renews the token of a client on a 401 with the
+// locked reauthentication of the session, then copies it to the client
+type sessionTokenRefresher struct {
+	client.TokenProvider
+	session *IBMRegistrySession
+	config  *ibmcloud.Config
+}
+
+func (r *sessionTokenRefresher) RefreshToken() (string, error) {
+	s := r.session
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The session may have renewed the token since the client copied it
+	if s.config.IAMAccessToken == r.config.IAMAccessToken {
+		if err := s.reauthenticate(); err != nil {
+			return "", err
+		}
+	}
+	r.config.IAMAccessToken = s.config.IAMAccessToken
+	r.config.IAMRefreshToken = s.config.IAMRefreshToken
+	return r.config.IAMAccessToken, nil
+}
+
+// buildAPI sends build requests the same way as registryv1.Builds but with
+// a client that has no token refresher. On a 401 that client refreshes the
+// token and sends the request again with a build context that was already
+// read, the Builder renews the token and sends the spooled context instead.
+type buildAPI struct {
+	client *client.Client
+}
+
+func newBuildAPI(sess *session.Session) (registryv1.Builds, error) {
+	config := sess.Config.Copy()
+	err := config.ValidateConfigForService(ibmcloud.ContainerRegistryService)
+	if err != nil {
+		return nil, err
+	}
+	return &buildAPI{
+		client: client.New(config, ibmcloud.ContainerRegistryService, nil),
+	}, nil
+}
+
+func (r *buildAPI) request(params registryv1.ImageBuildRequest, buildContext io.Reader, target registryv1.BuildTargetHeader) *rest.Request {
+	req := rest.PostRequest(helpers.GetFullURL(*r.client.Config.Endpoint, "/api/v1/builds")).
+		Query("t", params.T).
+		Query("dockerfile", params.Dockerfile).
+		Query("buildarg", params.Buildargs).
+		Query("nocache", strconv.FormatBool(params.Nocache)).
+		Query("pull", strconv.FormatBool(params.Pull)).
+		Query("quiet", strconv.FormatBool(params.Quiet)).
+		Query("squash", strconv.FormatBool(params.Squash)).
+		Body(buildContext)
+
+	for key, value := range target.ToMap() {
+		req.Set(key, value)
+	}
+	return req
+}
+
+// ImageBuild streams the build output to out
+func (r *buildAPI) ImageBuild(params registryv1.ImageBuildRequest, buildContext io.Reader, target registryv1.BuildTargetHeader, out io.Writer) error {
+	_, err := r.client.SendRequest(r.request(params, buildContext, target), out)
+	return err
+}
+
+// ImageBuildCallback calls callback with each message of the build output
+func (r *buildAPI) ImageBuildCallback(params registryv1.ImageBuildRequest, buildContext io.Reader, target registryv1.BuildTargetHeader, callback registryv1.ImageBuildResponseCallback) error {
+	_, err := r.client.SendRequest(r.request(params, buildContext, target), callback)
+	return err
+}
+
+// TagImage adds toImage as a new tag of the existing fromImage
+func (r *registry) TagImage(fromImage string, toImage string, target registryv1.ImageTargetHeader) error {
+	req := rest.PostRequest(helpers.GetFullURL(*r.client.Config.Endpoint, "/api/v1/images/tags")).
+		Query("fromimage", fromImage).
+		Query("toimage", toImage)
+
+	for key, value := range target.ToMap() {
+		req.Set(key, value)
+	}
+
+	_, err := r.client.SendRequest(req, nil)
+	return err
+}
+
+// UntagImage removes the tag of imageName, the image stays in the registry
+func (r *registry) UntagImage(imageName string, target registryv1.ImageTargetHeader) error {
+	req := rest.DeleteRequest(helpers.GetFullURL(*r.client.Config.Endpoint, fmt.Sprintf("/api/v1/images/%s/tag", imageName)))
+
+	for key, value := range target.ToMap() {
+		req.Set(key, value)
+	}
+
+	_, err := r.client.SendRequest(req, nil)
+	return err
+}
+
+// GetQuota of the account
+func (r *registry) GetQuota(target registryv1.ImageTargetHeader) (*Quota, error) {
+	var quota Quota
+	req := rest.GetRequest(helpers.GetFullURL(*r.client.Config.Endpoint, "/api/v1/quotas"))
+
+	for key, value := range target.ToMap() {
+		req.Set(key, value)
+	}
+
+	_, err := r.client.SendRequest(req, &quota)
+	if err != nil {
+		return nil, err
+	}
+	return &quota, nil
+}
+
+// GetPlan of the account
+func (r *registry) GetPlan(target registryv1.ImageTargetHeader) (*Plan, error) {
+	var plan Plan
+	req := rest.GetRequest(helpers.GetFullURL(*r.client.Config.Endpoint, "/api/v1/plans"))
+
+	for key, value := range target.ToMap() {
+		req.Set(key, value)
+	}
+
+	_, err := r.client.SendRequest(req, &plan)
+	if err != nil {
+		return nil, err
+	}
+	return &plan, nil
+}
+
+// ImageTargetHeader for the account of the session
+func (s *IBMRegistrySession) ImageTargetHeader() registryv1.ImageTargetHeader {
+	return registryv1.ImageTargetHeader{
+		AccountID: s.BuildTargetHeader.AccountID,
+	}
+}
+
+// ImageName adds the session registry to imageName if it has none and
+// rejects images that belong to another registry
+func (s *IBMRegistrySession) ImageName(imageName string) (string, error) {
+	return qualifyImageName(s.Registry, imageName)
+}
+
+func qualifyImageName(registry string, imageName string) (string, error) {
+	imageName, err := addRegistry(registryScheme+registry, imageName)
+	if err != nil {
+		return imageName, err
+	}
+	if endpoint := getRegistryEndpoint(imageName); endpoint == nil || *endpoint != registry {
+		return imageName, errors.Errorf("Image %s is not in registry %s", imageName, registry)
+	}
+	return imageName, nil
+}
+
+// ResolveDigest looks up the manifest digest that the tagged image points at
+func (s *IBMRegistrySession) ResolveDigest(imageName string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(imageName)
+	if err != nil {
+		return "", errors.Wrapf(err, "Unable to parse image name %s", imageName)
+	}
+	named = reference.TagNameOnly(named)
+	namespace, err := imageNamespace(imageName)
+	if err != nil {
+		return "", err
+	}
+
+	apis, err := s.Refresh()
+	if err != nil {
+		return "", err
+	}
+	images, err := apis.Images.GetImages(registryv1.GetImageRequest{
+		IncludePrivate: true,
+		Namespace:      namespace,
+	}, s.ImageTargetHeader())
+	if err != nil {
+		return "", errors.Wrapf(err, "Unable to list images in namespace %s", namespace)
+	}
+
+	for _, image := range *images {
+		for _, repoTag := range image.RepoTags {
+			if repoTag != named.String() {
+				continue
+			}
+			for _, repoDigest := range image.RepoDigests {
+				if i := strings.LastIndex(repoDigest, "@"); i >= 0 && repoDigest[:i] == named.Name() {
+					return repoDigest[i+1:], nil
+				}
+			}
+		}
+	}
+	return "", errors.Errorf("Image %s not found in registry", named)
+}
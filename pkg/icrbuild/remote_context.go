@@ -0,0 +1,284 @@
+// ------------------------------------------------------------------------------
+// Copyright IBM Corp. 2018
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ------------------------------------------------------------------------------
+
+// Package icrbuild ...
+package icrbuild
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/cli/cli/command/image/build"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/symlink"
+	"github.com/docker/docker/pkg/urlutil"
+	"github.com/docker/go-units"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// StdinContext is the context argument that reads a tar archive from stdin
+const StdinContext = "-"
+
+// ContextFetcher stages a build context that is not a local directory
+type ContextFetcher interface {
+	// Handles reports whether the fetcher stages the context
+	Handles(source string) bool
+	// Fetch stages the context in dir and returns the directory to build,
+	// dir or a directory below it
+	Fetch(ctx context.Context, source string, dir string) (string, error)
+}
+
+type logKey struct{}
+
+// withLog passes the log of the build to the context fetchers
+func withLog(ctx context.Context, log *logrus.Entry) context.Context {
+	return context.WithValue(ctx, logKey{}, log)
+}
+
+// logFrom returns the log of the build ctx belongs to, or the standard logger
+func logFrom(ctx context.Context) *logrus.Entry {
+	if log, ok := ctx.Value(logKey{}).(*logrus.Entry); ok {
+		return log
+	}
+	return logrus.NewEntry(logrus.StandardLogger())
+}
+
+// DefaultContextFetchers stage, in this order:
+//  1. a tar archive or a Dockerfile read from in, for the "-" context
+//  2. a git repository, for git://, git@, github.com/ and http(s) URLs
+//     ending in .git, with an optional #ref:subdir
+//  3. a tar archive or a Dockerfile downloaded from other http(s) URLs
+func DefaultContextFetchers(in io.Reader) []ContextFetcher {
+	return []ContextFetcher{
+		&stdinFetcher{in: in},
+		&gitFetcher{},
+		&archiveFetcher{client: http.DefaultClient},
+	}
+}
+
+// stageContext fetches a remote context into a temporary directory and
+// returns the directory to build and a function that removes it. Local
+// directories are returned as they are.
+func (o *BuildOptions) stageContext(ctx context.Context, source string) (string, func(), error) {
+	noop := func() {}
+
+	// A local directory wins over a URL like name, as with docker build
+	if info, err := os.Stat(source); err == nil && info.IsDir() {
+		return source, noop, nil
+	}
+
+	fetchers := o.ContextFetchers
+	if fetchers == nil {
+		fetchers = DefaultContextFetchers(o.In)
+	}
+	var fetcher ContextFetcher
+	for _, f := range fetchers {
+		if f.Handles(source) {
+			fetcher = f
+			break
+		}
+	}
+	if fetcher == nil {
+		return source, noop, nil
+	}
+
+	root, err := ioutil.TempDir("", "icrbuild-remote-context-")
+	if err != nil {
+		return "", noop, errors.Wrap(err, "Unable to create a directory for the build context")
+	}
+	cleanup := func() {
+		if err := os.RemoveAll(root); err != nil {
+			o.log.Warnf("Unable to remove the build context staged in %s: %v", root, err)
+		}
+	}
+
+	o.log.Infof("Fetching build context %s", source)
+	finish := o.events.phase(PhaseFetch)
+	dir, err := fetcher.Fetch(withLog(ctx, o.log), source, root)
+	finish(err)
+	if err != nil {
+		cleanup()
+		return "", noop, errors.Wrapf(err, "Unable to fetch build context %s", source)
+	}
+	if _, size, err := contextFiles(dir, nil); err == nil {
+		o.log.Infof("Staged build context in %s, %s", dir, units.BytesSize(float64(size)))
+	}
+
+	// The Dockerfile of a remote context is relative to the context, not to
+	// the working directory as it is for a local one
+	if o.Flags.File != "" && !filepath.IsAbs(o.Flags.File) {
+		o.Flags.File = filepath.Join(dir, o.Flags.File)
+	}
+	return dir, cleanup, nil
+}
+
+// stageArchive unpacks a tar archive, compressed or not, into dir. Any other
+// content is taken to be the Dockerfile of an otherwise empty context.
+func stageArchive(r io.Reader, dir string) error {
+	rc, isArchive, err := build.DetectArchiveReader(ioutil.NopCloser(r))
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if !isArchive {
+		file, err := os.Create(filepath.Join(dir, build.DefaultDockerfileName))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(file, rc)
+		return err
+	}
+	return archive.Untar(rc, dir, &archive.TarOptions{NoLchown: true})
+}
+
+// stdinFetcher stages the tar archive piped to icrbuild
+type stdinFetcher struct {
+	in io.Reader
+}
+
+func (f *stdinFetcher) Handles(source string) bool {
+	return source == StdinContext
+}
+
+func (f *stdinFetcher) Fetch(ctx context.Context, source string, dir string) (string, error) {
+	if f.in == nil {
+		return "", errors.New("No input to read the build context from")
+	}
+	return dir, stageArchive(f.in, dir)
+}
+
+// archiveFetcher downloads a tar archive or a Dockerfile
+type archiveFetcher struct {
+	client *http.Client
+}
+
+func (f *archiveFetcher) Handles(source string) bool {
+	return urlutil.IsURL(source)
+}
+
+func (f *archiveFetcher) Fetch(ctx context.Context, source string, dir string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, source, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := f.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return "", errors.Errorf("Download failed with status %s", resp.Status)
+	}
+	return dir, stageArchive(resp.Body, dir)
+}
+
+// gitFetcher clones a repository with the git CLI. The URL fragment selects
+// the ref to check out and the directory to build, as with docker build.
+type gitFetcher struct{}
+
+func (f *gitFetcher) Handles(source string) bool {
+	return urlutil.IsGitURL(source)
+}
+
+func (f *gitFetcher) Fetch(ctx context.Context, source string, dir string) (string, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return "", errors.Wrap(err, "Unable to find git")
+	}
+	remote, ref, subdir := parseGitURL(source)
+
+	if err := runGit(ctx, dir, "init", "--quiet"); err != nil {
+		return "", err
+	}
+	if err := runGit(ctx, dir, "remote", "add", "origin", remote); err != nil {
+		return "", err
+	}
+	// Not every server supports shallow fetches
+	if err := runGit(ctx, dir, "fetch", "--quiet", "--depth", "1", "origin", ref); err != nil {
+		logFrom(ctx).Debugf("Shallow fetch of %s failed, fetching all of it: %v", remote, err)
+		if err := runGit(ctx, dir, "fetch", "--quiet", "origin", ref); err != nil {
+			return "", err
+		}
+	}
+	if err := runGit(ctx, dir, "checkout", "--quiet", "FETCH_HEAD"); err != nil {
+		return "", err
+	}
+	if err := runGit(ctx, dir, "submodule", "--quiet", "update", "--init", "--recursive", "--depth", "1"); err != nil {
+		return "", err
+	}
+	// The history is not part of the context, it would only make the upload bigger
+	if err := os.RemoveAll(filepath.Join(dir, ".git")); err != nil {
+		return "", err
+	}
+
+	if subdir == "" {
+		return dir, nil
+	}
+	contextDir, err := symlink.FollowSymlinkInScope(filepath.Join(dir, subdir), dir)
+	if err != nil {
+		return "", errors.Wrapf(err, "Directory %s is not within the repository", subdir)
+	}
+	if info, err := os.Stat(contextDir); err != nil || !info.IsDir() {
+		return "", errors.Errorf("Directory %s does not exist in the repository", subdir)
+	}
+	return contextDir, nil
+}
+
+// parseGitURL splits the #ref:subdir fragment off a git URL, the ref is
+// HEAD when it is not given
+func parseGitURL(source string) (remote string, ref string, subdir string) {
+	remote = source
+	var fragment string
+	if i := strings.Index(source, "#"); i >= 0 {
+		remote, fragment = source[:i], source[i+1:]
+	}
+	if strings.HasPrefix(remote, "github.com/") {
+		remote = "https://" + remote
+	}
+
+	ref = "HEAD"
+	parts := strings.SplitN(fragment, ":", 2)
+	if parts[0] != "" {
+		ref = parts[0]
+	}
+	if len(parts) == 2 {
+		subdir = parts[1]
+	}
+	return remote, ref, subdir
+}
+
+func runGit(ctx context.Context, dir string, args ...string) error {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	// Never wait for credentials on a terminal nobody is looking at
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "git %s failed: %s", args[0], strings.TrimSpace(output.String()))
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+// ------------------------------------------------------------------------------
+// Copyright IBM Corp. 2018
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ------------------------------------------------------------------------------
+
+// Package icrbuild ...
+package icrbuild
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Result file names written to the results directory
+const (
+	ResultImageDigest   = "IMAGE_DIGEST"
+	ResultImageURL      = "IMAGE_URL"
+	ResultBuildDuration = "BUILD_DURATION"
+)
+
+// builtDigest of the pushed image. The digest reported in the build stream is
+// preferred, the registry is only asked when the stream did not carry one and
+// the digest is needed.
+func (o *BuildOptions) builtDigest(registryClient *IBMRegistrySession, imageName string, digest string) (string, error) {
+	if digest != "" || (o.Flags.DigestFile == "" && o.Flags.ResultsDir == "" && !o.events.enabled()) {
+		return digest, nil
+	}
+	o.log.Debugf("Build stream did not report a digest, resolving %s", imageName)
+	digest, err := registryClient.ResolveDigest(imageName)
+	if err != nil {
+		return "", errors.Wrap(err, "Unable to determine the digest of the built image")
+	}
+	return digest, nil
+}
+
+// writeResults records the digest of the pushed image for later build steps
+func (o *BuildOptions) writeResults(imageName string, digest string) error {
+	if o.Flags.DigestFile == "" && o.Flags.ResultsDir == "" {
+		return nil
+	}
+
+	o.log.Infof("Built %s@%s", imageName, digest)
+
+	if o.Flags.DigestFile != "" {
+		if err := writeResult(o.Flags.DigestFile, digest); err != nil {
+			return err
+		}
+	}
+	if o.Flags.ResultsDir != "" {
+		if err := os.MkdirAll(o.Flags.ResultsDir, 0755); err != nil {
+			return errors.Wrapf(err, "Unable to create results directory %s", o.Flags.ResultsDir)
+		}
+		if err := writeResult(filepath.Join(o.Flags.ResultsDir, ResultImageDigest), digest); err != nil {
+			return err
+		}
+		if err := writeResult(filepath.Join(o.Flags.ResultsDir, ResultImageURL), imageName); err != nil {
+			return err
+		}
+		// Whole seconds since the start of the build, results are plain strings
+		duration := strconv.Itoa(int(time.Since(o.start).Seconds()))
+		if err := writeResult(filepath.Join(o.Flags.ResultsDir, ResultBuildDuration), duration); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeResult(path string, value string) error {
+	if err := ioutil.WriteFile(path, []byte(value), 0644); err != nil {
+		return errors.Wrapf(err, "Unable to write result %s", path)
+	}
+	return nil
+}
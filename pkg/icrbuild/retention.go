@@ -0,0 +1,228 @@
+// ------------------------------------------------------------------------------
+// Copyright IBM Corp. 2018
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ------------------------------------------------------------------------------
+
+// Package icrbuild ...
+package icrbuild
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IBM-Cloud/bluemix-go/api/container/registryv1"
+	"github.com/docker/distribution/reference"
+	"github.com/pkg/errors"
+)
+
+// retainedImage is an image of the built repository, identified by digest
+type retainedImage struct {
+	Name    string
+	Digest  string
+	Tags    []string
+	Created time.Time
+}
+
+// ParseRetainWithin parses a duration that also accepts a number of days, such as 30d
+func ParseRetainWithin(value string) (time.Duration, error) {
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil || days < 0 {
+			return 0, errors.Errorf("Invalid retention period %s", value)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	period, err := time.ParseDuration(value)
+	if err != nil || period < 0 {
+		return 0, errors.Errorf("Invalid retention period %s", value)
+	}
+	return period, nil
+}
+
+// validateRetentionFlags checks the retention flags
+func (o *BuildOptions) validateRetentionFlags() error {
+	if o.Flags.Retain < 0 {
+		return errors.Errorf("Number of images to retain %d is negative", o.Flags.Retain)
+	}
+	if o.Flags.RetainWithin != "" {
+		if _, err := ParseRetainWithin(o.Flags.RetainWithin); err != nil {
+			return err
+		}
+	}
+	if o.Flags.RetainProtect != "" {
+		if _, err := regexp.Compile(o.Flags.RetainProtect); err != nil {
+			return errors.Wrapf(err, "Invalid protected tag pattern %s", o.Flags.RetainProtect)
+		}
+	}
+	return nil
+}
+
+// applyRetention deletes the images of the built repository that are neither
+// among the newest --retain images nor created within --retain-within. The
+// image that was just built and images with a protected tag are always kept.
+// Cleanup failures are reported as warnings since the build itself succeeded.
+func (o *BuildOptions) applyRetention(registryClient *IBMRegistrySession, imageName string, digest string) error {
+	if o.Flags.Retain == 0 && o.Flags.RetainWithin == "" {
+		return nil
+	}
+
+	var (
+		within  time.Duration
+		protect *regexp.Regexp
+		err     error
+	)
+	if o.Flags.RetainWithin != "" {
+		if within, err = ParseRetainWithin(o.Flags.RetainWithin); err != nil {
+			return newBuildError(ErrUsage, err)
+		}
+	}
+	if o.Flags.RetainProtect != "" {
+		if protect, err = regexp.Compile(o.Flags.RetainProtect); err != nil {
+			return newBuildError(ErrUsage, err)
+		}
+	}
+
+	if digest == "" {
+		if digest, err = registryClient.ResolveDigest(imageName); err != nil {
+			o.log.Warnf("Skipping image cleanup, unable to determine the digest of the built image: %v", err)
+			return nil
+		}
+	}
+
+	images, err := o.listRepositoryImages(registryClient, imageName)
+	if err != nil {
+		o.log.Warnf("Skipping image cleanup: %v", err)
+		return nil
+	}
+
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].Created.After(images[j].Created)
+	})
+
+	for i, image := range images {
+		switch {
+		case image.Digest == digest:
+			o.log.Debugf("Retaining %s, it was just built", image.Name)
+		case protectedTag(protect, image.Tags) != "":
+			o.log.Debugf("Retaining %s, tag %s is protected", image.Name, protectedTag(protect, image.Tags))
+		case o.Flags.Retain > 0 && i < o.Flags.Retain:
+			o.log.Debugf("Retaining %s, it is one of the newest %d images", image.Name, o.Flags.Retain)
+		case within > 0 && time.Since(image.Created) < within:
+			o.log.Debugf("Retaining %s, it was created within %v", image.Name, within)
+		case o.Flags.RetainDryRun:
+			o.reportDeletion("Would delete", image)
+		default:
+			if err := o.deleteImage(registryClient, image.Name); err != nil {
+				o.log.Warnf("Unable to delete %s: %v", image.Name, err)
+				continue
+			}
+			o.reportDeletion("Deleted", image)
+		}
+	}
+	return nil
+}
+
+// listRepositoryImages of the repository of imageName, by digest
+func (o *BuildOptions) listRepositoryImages(registryClient *IBMRegistrySession, imageName string) ([]retainedImage, error) {
+	named, err := reference.ParseNormalizedNamed(imageName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to parse image name %s", imageName)
+	}
+	namespace, err := imageNamespace(imageName)
+	if err != nil {
+		return nil, err
+	}
+
+	var response *registryv1.GetImagesResponse
+	apis, err := registryClient.Refresh()
+	if err != nil {
+		return nil, err
+	}
+	err = registryClient.retry.withLog(o.log).Do(registryClient.ctx, "Listing images", func() (err error) {
+		response, err = apis.Images.GetImages(registryv1.GetImageRequest{
+			IncludePrivate: true,
+			Namespace:      namespace,
+			Repository:     reference.Path(named),
+		}, registryClient.ImageTargetHeader())
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to list images of %s", named.Name())
+	}
+
+	var images []retainedImage
+	for _, image := range *response {
+		for _, repoDigest := range image.RepoDigests {
+			i := strings.LastIndex(repoDigest, "@")
+			if i < 0 || repoDigest[:i] != named.Name() {
+				continue
+			}
+			retained := retainedImage{
+				Name:    repoDigest,
+				Digest:  repoDigest[i+1:],
+				Created: time.Unix(int64(image.Created), 0),
+			}
+			for _, repoTag := range image.RepoTags {
+				if j := strings.LastIndex(repoTag, ":"); j >= 0 && repoTag[:j] == named.Name() {
+					retained.Tags = append(retained.Tags, repoTag[j+1:])
+				}
+			}
+			images = append(images, retained)
+		}
+	}
+	return images, nil
+}
+
+func (o *BuildOptions) deleteImage(registryClient *IBMRegistrySession, imageName string) error {
+	apis, err := registryClient.Refresh()
+	if err != nil {
+		return err
+	}
+	return registryClient.retry.withLog(o.log).Do(registryClient.ctx, "Deleting image", func() error {
+		_, err := apis.Images.DeleteImage(imageName, registryClient.ImageTargetHeader())
+		return err
+	})
+}
+
+func (o *BuildOptions) reportDeletion(action string, image retainedImage) {
+	if o.events.enabled() {
+		o.events.emit(Event{Type: EventDelete, Phase: PhaseCleanup, Image: image.Name, Digest: image.Digest, Message: action})
+		return
+	}
+	fmt.Fprintf(o.Out, "%s %s %s created %s\n", action, image.Name, formatTags(image.Tags), image.Created.Format(time.RFC3339))
+}
+
+// protectedTag returns the first tag that matches the pattern, if any
+func protectedTag(protect *regexp.Regexp, tags []string) string {
+	if protect == nil {
+		return ""
+	}
+	for _, tag := range tags {
+		if protect.MatchString(tag) {
+			return tag
+		}
+	}
+	return ""
+}
+
+func formatTags(tags []string) string {
+	if len(tags) == 0 {
+		return "(untagged)"
+	}
+	return "(" + strings.Join(tags, ", ") + ")"
+}
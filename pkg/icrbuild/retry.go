@@ -0,0 +1,166 @@
+// ------------------------------------------------------------------------------
+// Copyright IBM Corp. 2018
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ------------------------------------------------------------------------------
+
+// Package icrbuild ...
+package icrbuild
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/IBM-Cloud/bluemix-go/bmxerror"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// RetryPolicy for requests that fail with transient errors
+type RetryPolicy struct {
+	// MaxAttempts including the first one, values below 1 mean a single attempt
+	MaxAttempts int
+	// InitialBackoff before the second attempt, doubled for each further attempt
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between attempts
+	MaxBackoff time.Duration
+
+	// log of the retries, the standard logger when nil
+	log *logrus.Entry
+}
+
+// DefaultRetryPolicy tries 4 times over about 15 seconds
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    4,
+	InitialBackoff: 2 * time.Second,
+	MaxBackoff:     30 * time.Second,
+}
+
+// withLog returns the policy logging its retries to log
+func (p RetryPolicy) withLog(log *logrus.Entry) RetryPolicy {
+	p.log = log
+	return p
+}
+
+// Do calls fn until it succeeds, fails with an error that is not retryable,
+// the attempts are used up or ctx is done
+func (p RetryPolicy) Do(ctx context.Context, operation string, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if perm, ok := err.(permanentError); ok {
+			return perm.error
+		}
+		if err == nil || attempt >= p.MaxAttempts || ctx.Err() != nil || !isRetryable(err) {
+			return err
+		}
+
+		delay := p.backoff(attempt)
+		log := p.log
+		if log == nil {
+			log = logrus.NewEntry(logrus.StandardLogger())
+		}
+		log.Warnf("%s failed, retrying in %v (attempt %d of %d): %v", operation, delay, attempt+1, p.MaxAttempts, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// permanentError is returned by the function passed to RetryPolicy.Do to
+// stop the retries regardless of the error
+type permanentError struct {
+	error
+}
+
+// backoff before the attempt after the given one, with jitter so that
+// concurrent builds do not retry in lock step
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.InitialBackoff
+	for i := 1; i < attempt && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// isRetryable reports whether err is a gateway or availability error of the
+// service or a transient network failure, retrying anything else will fail again
+func isRetryable(err error) bool {
+	cause := errors.Cause(err)
+	if cause == context.Canceled || cause == context.DeadlineExceeded {
+		return false
+	}
+	if reqErr, ok := cause.(bmxerror.RequestFailure); ok {
+		switch reqErr.StatusCode() {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	return isTransientNetworkError(cause)
+}
+
+// transientNetworkMessages identify the network failures that
+// bmxerror.WrapNetworkErrors turned into plain errors
+var transientNetworkMessages = []string{
+	syscall.ECONNREFUSED.Error(),
+	syscall.ECONNRESET.Error(),
+	"i/o timeout",
+	"Client.Timeout exceeded",
+	io.ErrUnexpectedEOF.Error(),
+}
+
+// isTransientNetworkError is a timeout, a refused or reset connection or an
+// unexpected EOF. Other network errors such as TLS failures or a bad URL
+// are not retried.
+func isTransientNetworkError(err error) bool {
+	switch e := err.(type) {
+	case nil, bmxerror.Error:
+		return false
+	case *url.Error:
+		return e.Timeout() || isTransientNetworkError(e.Err)
+	case *net.OpError:
+		return e.Timeout() || isTransientNetworkError(e.Err)
+	case *os.SyscallError:
+		return isTransientNetworkError(e.Err)
+	case syscall.Errno:
+		return e == syscall.ECONNREFUSED || e == syscall.ECONNRESET || e.Timeout()
+	case net.Error:
+		return e.Timeout()
+	}
+	if err == io.ErrUnexpectedEOF {
+		return true
+	}
+	msg := err.Error()
+	for _, transient := range transientNetworkMessages {
+		if strings.Contains(msg, transient) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+// ------------------------------------------------------------------------------
+// Copyright IBM Corp. 2018
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ------------------------------------------------------------------------------
+
+// Package icrbuild ...
+package icrbuild
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// TektonResultsDir is where a Tekton step writes its results
+	TektonResultsDir = "/tekton/results"
+	// TektonSourceWorkspace is the path of a workspace named source
+	TektonSourceWorkspace = "/workspace/source"
+
+	contextEnvVar = "ICRBUILD_CONTEXT"
+)
+
+// InTekton reports whether icrbuild runs as a step of a Tekton Task
+func InTekton() bool {
+	info, err := os.Stat(TektonResultsDir)
+	return err == nil && info.IsDir()
+}
+
+// buildContextPath is the DIRECTORY argument, ICRBUILD_CONTEXT, or the source
+// workspace when running in Tekton
+func buildContextPath(args []string) (string, error) {
+	if len(args) > 0 {
+		return args[0], nil
+	}
+	if path := os.Getenv(contextEnvVar); path != "" {
+		return path, nil
+	}
+	if InTekton() {
+		return TektonSourceWorkspace, nil
+	}
+	return "", errors.Errorf("A build context DIRECTORY or %s is required", contextEnvVar)
+}
+
+// applyTektonDefaults writes the results for the Task unless told otherwise
+func (o *BuildOptions) applyTektonDefaults() {
+	if o.Flags.ResultsDir == "" && InTekton() {
+		o.Flags.ResultsDir = TektonResultsDir
+	}
+}
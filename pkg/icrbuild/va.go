@@ -0,0 +1,272 @@
+// ------------------------------------------------------------------------------
+// Copyright IBM Corp. 2018
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// ------------------------------------------------------------------------------
+
+// Package icrbuild ...
+package icrbuild
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IBM-Cloud/bluemix-go/api/container/registryv1"
+	"github.com/docker/distribution/reference"
+	"github.com/pkg/errors"
+)
+
+const vaPollInterval = 15 * time.Second
+
+// Actions taken on the image when it violates the Vulnerability Advisor policy
+const (
+	VAActionFail   = "fail"
+	VAActionDelete = "delete"
+	VAActionRetag  = "retag"
+)
+
+// vaQuarantineSuffix is appended to the tag of an image retagged by VAActionRetag
+const vaQuarantineSuffix = "-va-failed"
+
+// VAPolicy thresholds for the Vulnerability Advisor report, negative values are not checked.
+// The registry report counts vulnerable packages rather than individual
+// vulnerabilities by severity, so that is what the vulnerability limit applies to.
+type VAPolicy struct {
+	MaxVulnerablePackages   int
+	MaxComplianceViolations int
+	AllowMalware            bool
+}
+
+// ParseVAPolicy parses a comma separated list of KEY=VALUE thresholds.
+// Supported keys are vulnerabilities, compliance and malware (allow or deny).
+func ParseVAPolicy(value string) (*VAPolicy, error) {
+	policy := &VAPolicy{
+		MaxVulnerablePackages:   -1,
+		MaxComplianceViolations: -1,
+	}
+
+	for _, setting := range strings.Split(value, ",") {
+		setting = strings.TrimSpace(setting)
+		if setting == "" {
+			continue
+		}
+		kv := strings.SplitN(setting, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.Errorf("Invalid VA policy setting %q, expected KEY=VALUE", setting)
+		}
+		key, val := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch key {
+		case "vulnerabilities", "compliance":
+			limit, err := strconv.Atoi(val)
+			if err != nil || limit < 0 {
+				return nil, errors.Errorf("Invalid VA policy limit %q for %s", val, key)
+			}
+			if key == "vulnerabilities" {
+				policy.MaxVulnerablePackages = limit
+			} else {
+				policy.MaxComplianceViolations = limit
+			}
+		case "malware":
+			switch val {
+			case "allow":
+				policy.AllowMalware = true
+			case "deny":
+				policy.AllowMalware = false
+			default:
+				return nil, errors.Errorf("Invalid VA policy value %q for malware, expected allow or deny", val)
+			}
+		default:
+			return nil, errors.Errorf("Unknown VA policy setting %q", key)
+		}
+	}
+	return policy, nil
+}
+
+// Violations of the policy found in the report
+func (p *VAPolicy) Violations(report *registryv1.ImageVulnerabilitiesResponse) []string {
+	var violations []string
+
+	summary := report.Summary
+	if p.MaxVulnerablePackages >= 0 && summary.Vulnerability.VulnerablePackages > p.MaxVulnerablePackages {
+		violations = append(violations, fmt.Sprintf("%d vulnerable packages exceed the limit of %d",
+			summary.Vulnerability.VulnerablePackages, p.MaxVulnerablePackages))
+	}
+	if p.MaxComplianceViolations >= 0 && summary.Compliance.ComplianceViolations > p.MaxComplianceViolations {
+		violations = append(violations, fmt.Sprintf("%d failing compliance checks exceed the limit of %d",
+			summary.Compliance.ComplianceViolations, p.MaxComplianceViolations))
+	}
+	if !p.AllowMalware && !summary.Malware.Compliant {
+		violations = append(violations, fmt.Sprintf("malware found: %s", summary.Malware.Reason))
+	}
+	return violations
+}
+
+// validateVAFlags checks the --va-policy and --va-action flags
+func (o *BuildOptions) validateVAFlags() error {
+	if o.Flags.VAPolicy == "" {
+		return nil
+	}
+	if _, err := ParseVAPolicy(o.Flags.VAPolicy); err != nil {
+		return err
+	}
+	switch o.Flags.VAAction {
+	case "", VAActionFail, VAActionDelete, VAActionRetag:
+		return nil
+	}
+	return errors.Errorf("Unknown VA action %s, expected %s, %s or %s", o.Flags.VAAction, VAActionFail, VAActionDelete, VAActionRetag)
+}
+
+// checkVulnerabilities waits for the Vulnerability Advisor to scan the image,
+// prints the report and applies the policy
+func (o *BuildOptions) checkVulnerabilities(ctx context.Context, registryClient *IBMRegistrySession, imageNames []string) error {
+	if o.Flags.VAPolicy == "" {
+		return nil
+	}
+
+	policy, err := ParseVAPolicy(o.Flags.VAPolicy)
+	if err != nil {
+		return newBuildError(ErrUsage, err)
+	}
+
+	report, err := o.waitForVulnerabilityReport(ctx, registryClient, imageNames[0], o.Flags.VATimeout)
+	if err != nil {
+		return err
+	}
+
+	if o.events.enabled() {
+		o.events.emit(Event{Type: EventScan, Phase: PhaseScan, Image: imageNames[0], Data: report.Summary})
+	} else {
+		printVulnerabilityReport(o.Out, imageNames[0], report)
+	}
+
+	violations := policy.Violations(report)
+	if len(violations) == 0 {
+		o.log.Infof("Image %s passed the Vulnerability Advisor policy", imageNames[0])
+		return nil
+	}
+
+	err = errors.Errorf("Image %s violates the Vulnerability Advisor policy: %s", imageNames[0], strings.Join(violations, "; "))
+	if actionErr := o.applyVAAction(registryClient, o.Flags.VAAction, imageNames); actionErr != nil {
+		o.log.Errorf("Unable to %s image after policy violation: %v", o.Flags.VAAction, actionErr)
+	}
+	return newBuildError(ErrPolicy, err)
+}
+
+func (o *BuildOptions) waitForVulnerabilityReport(ctx context.Context, registryClient *IBMRegistrySession, imageName string, timeout time.Duration) (*registryv1.ImageVulnerabilitiesResponse, error) {
+	parent := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	o.log.Infof("Waiting for the Vulnerability Advisor to scan %s", imageName)
+	for {
+		apis, err := registryClient.Refresh()
+		if err != nil {
+			return nil, newBuildError(ErrAuth, err)
+		}
+		report, err := apis.Images.ImageVulnerabilities(imageName, registryv1.ImageVulnerabilitiesRequest{}, registryClient.ImageTargetHeader())
+		if err == nil && report.Metadata.Complete {
+			return report, nil
+		}
+		// The report is not available until the scan has finished
+		if err != nil {
+			o.log.Debugf("Vulnerability report for %s not available yet: %v", imageName, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			// SIGINT or --timeout, only --va-timeout is a policy failure
+			if parent.Err() != nil {
+				return nil, newBuildError(ErrCancelled, cancelledError(parent))
+			}
+			if err == nil {
+				err = errors.New("scan did not complete")
+			}
+			return nil, newBuildError(ErrPolicy, errors.Wrapf(err, "Timed out waiting for the Vulnerability Advisor report of %s", imageName))
+		case <-time.After(vaPollInterval):
+		}
+	}
+}
+
+func printVulnerabilityReport(out io.Writer, imageName string, report *registryv1.ImageVulnerabilitiesResponse) {
+	summary := report.Summary
+
+	fmt.Fprintf(out, "Vulnerability Advisor report for %s\n", imageName)
+	if !report.Metadata.OsSupported {
+		fmt.Fprintf(out, "  The image OS is not supported by the Vulnerability Advisor\n")
+	}
+	fmt.Fprintf(out, "  Vulnerable packages:  %d of %d\n", summary.Vulnerability.VulnerablePackages, summary.Vulnerability.TotalPackages)
+	fmt.Fprintf(out, "  Compliance failures:  %d of %d\n", summary.Compliance.ComplianceViolations, summary.Compliance.TotalComplianceRules)
+	fmt.Fprintf(out, "  Malware compliant:    %t\n", summary.Malware.Compliant)
+
+	for _, pkg := range report.Detail.Vulnerability {
+		for _, vulnerability := range pkg.Vulnerabilities {
+			fmt.Fprintf(out, "  %s: %s %s\n", pkg.PackageName, strings.Join(vulnerability.Cveid, ","), vulnerability.Summary)
+		}
+	}
+	for _, check := range report.Detail.Compliance {
+		if !check.Compliant {
+			fmt.Fprintf(out, "  Compliance: %s %s\n", check.Description, check.Reason)
+		}
+	}
+}
+
+// applyVAAction removes or marks an image that violated the policy
+func (o *BuildOptions) applyVAAction(registryClient *IBMRegistrySession, action string, imageNames []string) error {
+	apis, err := registryClient.Refresh()
+	if err != nil {
+		return err
+	}
+	switch action {
+	case "", VAActionFail:
+		return nil
+	case VAActionDelete:
+		for _, imageName := range imageNames {
+			o.log.Warnf("Deleting image %s", imageName)
+			_, err := apis.Images.DeleteImage(imageName, registryClient.ImageTargetHeader())
+			// The tags share the image, deleting one of them may delete the others
+			if err != nil && !isNotFoundRequest(err) {
+				return errors.Wrapf(err, "Unable to delete %s", imageName)
+			}
+		}
+		return nil
+	case VAActionRetag:
+		// Every tag is moved so that nothing pulls the image by its usual names
+		for _, imageName := range imageNames {
+			named, err := reference.ParseNormalizedNamed(imageName)
+			if err != nil {
+				return err
+			}
+			tagged, ok := reference.TagNameOnly(named).(reference.NamedTagged)
+			if !ok {
+				return errors.Errorf("Unable to move %s, it is not a tag", imageName)
+			}
+			quarantined := fmt.Sprintf("%s:%s%s", tagged.Name(), tagged.Tag(), vaQuarantineSuffix)
+			o.log.Warnf("Moving tag %s to %s", imageName, quarantined)
+			if err = apis.RegistryAPI.TagImage(imageName, quarantined, registryClient.ImageTargetHeader()); err != nil {
+				return errors.Wrapf(err, "Unable to tag %s as %s", imageName, quarantined)
+			}
+			if err = apis.RegistryAPI.UntagImage(imageName, registryClient.ImageTargetHeader()); err != nil {
+				return errors.Wrapf(err, "Unable to untag %s", imageName)
+			}
+		}
+		return nil
+	}
+	return errors.Errorf("Unknown VA action %s", action)
+}